@@ -0,0 +1,372 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "encoding/binary"
+  "go.etcd.io/bbolt"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+//boltSessionsBucket is the top level bucket holding one
+//bucket per session
+var boltSessionsBucket = []byte("kyogetsu")
+
+//boltProdBucket and boltStagingBucket link production and
+//staging session ids, keyed by one and holding the other
+var boltProdBucket = []byte("kyogetsu.prod")
+var boltStagingBucket = []byte("kyogetsu.staging")
+
+//boltRetiredBucket holds the old ids kept for their grace
+//period after ChangeCookiesId.  The keys are the deadline in
+//milliseconds followed by the id, so the oldest come first
+var boltRetiredBucket = []byte("kyogetsu.retired")
+
+//A CookieCache that stores the cookies in a single file on
+//disk using bbolt, so staging sessions survive a restart of
+//the proxy without running Redis.  Each session is a bucket
+//holding one key per cookie name, with the cookie and all of
+//its attributes as the value.  Every write is a bbolt
+//transaction, which is atomic and synced to disk before it
+//returns, so a crash never leaves a half written session.
+//Only one process can have the file open at a time
+type BoltCache struct {
+  db *bbolt.DB
+  conflict IdConflictPolicy
+  grace time.Duration
+  now func() time.Time
+}
+
+//NewBoltCache opens the cache stored at path, creating the
+//file if it does not exist.  It fails if another process
+//holds the file for longer than timeout
+func NewBoltCache(path string, timeout time.Duration) (*BoltCache, error) {
+  db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: timeout})
+  if err != nil {
+    return nil, err
+  }
+  err = db.Update(func(tx *bbolt.Tx) error {
+    for _, b := range [][]byte{boltSessionsBucket, boltProdBucket, boltStagingBucket, boltRetiredBucket} {
+      if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    db.Close()
+    return nil, err
+  }
+  return &BoltCache{db: db, grace: DefaultOldIdGrace, now: time.Now}, nil
+}
+
+//SetChangeIdPolicy sets how ChangeCookiesId merges the cookies
+//of the old id into those of the new id, and how long the old
+//id keeps working afterwards.  A grace of zero removes the old
+//id at once.  The default is OldIdWins with DefaultOldIdGrace.
+//It must be called before the cache is used
+func (b *BoltCache) SetChangeIdPolicy(conflict IdConflictPolicy, grace time.Duration) {
+  b.conflict = conflict
+  b.grace = grace
+}
+
+//SetCookie serializes an *http.Cookie and stores it in the
+//id's bucket
+func (b *BoltCache) SetCookie(id string, c *http.Cookie) error {
+  return b.SetCookies(id, []*http.Cookie{c})
+}
+
+//SetCookies serializes an array of *http.Cookies and stores
+//them in the id's bucket in one transaction
+func (b *BoltCache) SetCookies(id string, c []*http.Cookie) error {
+  //Incase there are no cookies to add, just return
+  if len(c) == 0 {
+    return nil
+  }
+  now := b.now()
+  return b.db.Update(func(tx *bbolt.Tx) error {
+    s, err := boltCreateSession(tx.Bucket(boltSessionsBucket), id, now)
+    if err != nil {
+      return err
+    }
+    for _, v := range c {
+      if err := s.Put([]byte(v.Name), []byte(encodeCookie(v, now))); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+//GetCookie gets a cookie stored in the id's bucket
+func (b *BoltCache) GetCookie(id string, key string) (*http.Cookie, error) {
+  var c *http.Cookie
+  now := b.now()
+  err := b.db.View(func(tx *bbolt.Tx) error {
+    s := boltSession(tx.Bucket(boltSessionsBucket), id, now)
+    if s == nil {
+      return ErrCookieNotFound
+    }
+    v := s.Get([]byte(key))
+    if v == nil {
+      return ErrCookieNotFound
+    }
+    c = decodeCookie(key, string(v))
+    return nil
+  })
+  return c, err
+}
+
+//GetCookies gets all cookies stored for a given Id
+func (b *BoltCache) GetCookies(id string) ([]*http.Cookie, error) {
+  c := []*http.Cookie{}
+  now := b.now()
+  err := b.db.View(func(tx *bbolt.Tx) error {
+    s := boltSession(tx.Bucket(boltSessionsBucket), id, now)
+    if s == nil {
+      return nil
+    }
+    return s.ForEach(func(k, v []byte) error {
+      if string(k) != sessionExpiresField {
+        c = append(c, decodeCookie(string(k), string(v)))
+      }
+      return nil
+    })
+  })
+  if err != nil {
+    return nil, err
+  }
+  return c, nil
+}
+
+//DeleteCookie removes a cookie from the id's bucket
+func (b *BoltCache) DeleteCookie(id string, key string) error {
+  return b.DeleteCookies(id, []string{key})
+}
+
+//DeleteCookies removes the named cookies from the id's
+//bucket, and the bucket itself once it is empty
+func (b *BoltCache) DeleteCookies(id string, keys []string) error {
+  if len(keys) == 0 {
+    return nil
+  }
+  now := b.now()
+  return b.db.Update(func(tx *bbolt.Tx) error {
+    sessions := tx.Bucket(boltSessionsBucket)
+    s := boltSession(sessions, id, now)
+    if s == nil {
+      return nil
+    }
+    for _, k := range keys {
+      if err := s.Delete([]byte(k)); err != nil {
+        return err
+      }
+    }
+    if k, _ := s.Cursor().First(); k == nil {
+      return sessions.DeleteBucket([]byte(id))
+    }
+    return nil
+  })
+}
+
+//ChangeCookiesId merges the cookies of old_id into new_id,
+//following the IdConflictPolicy.  old_id is removed once its
+//grace period, set by SetChangeIdPolicy, is over.  Nothing
+//happens to the cookies if old_id has none.  The staging
+//session link moves to new_id unless it has one.  The merge
+//happens in one transaction, so the session is never lost, and
+//a conflict leaves both ids untouched.  The old ids whose grace
+//period is over are removed at the same time
+func (b *BoltCache) ChangeCookiesId(old_id string, new_id string) error {
+  now := b.now()
+  return b.db.Update(func(tx *bbolt.Tx) error {
+    sessions := tx.Bucket(boltSessionsBucket)
+    if err := boltRemoveRetired(tx, now); err != nil {
+      return err
+    }
+    if old_id == new_id {
+      return nil
+    }
+    old := boltSession(sessions, old_id, now)
+    if old == nil {
+      return boltMoveLink(tx, old_id, new_id)
+    }
+    s, err := boltCreateSession(sessions, new_id, now)
+    if err != nil {
+      return err
+    }
+    err = old.ForEach(func(k, v []byte) error {
+      if string(k) == sessionExpiresField {
+        return nil
+      }
+      if s.Get(k) == nil || b.conflict == OldIdWins {
+        return s.Put(k, v)
+      }
+      if b.conflict == FailOnConflict {
+        return ErrIdConflict
+      }
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+    if err = boltMoveLink(tx, old_id, new_id); err != nil {
+      return err
+    }
+    if b.grace <= 0 {
+      return sessions.DeleteBucket([]byte(old_id))
+    }
+    return boltRetire(tx, old, old_id, now.Add(b.grace))
+  })
+}
+
+//boltMoveLink moves the staging session link of old_id to
+//new_id, unless new_id already has one
+func boltMoveLink(tx *bbolt.Tx, old_id string, new_id string) error {
+  prod := tx.Bucket(boltProdBucket)
+  sid := prod.Get([]byte(old_id))
+  if sid == nil || prod.Get([]byte(new_id)) != nil {
+    return nil
+  }
+  //the value is only valid until the bucket is changed
+  sid = append([]byte(nil), sid...)
+  if err := prod.Put([]byte(new_id), sid); err != nil {
+    return err
+  }
+  if err := tx.Bucket(boltStagingBucket).Put(sid, []byte(new_id)); err != nil {
+    return err
+  }
+  return prod.Delete([]byte(old_id))
+}
+
+//boltSession returns the id's bucket, or nil if there is none
+//or its grace period is over
+func boltSession(sessions *bbolt.Bucket, id string, now time.Time) *bbolt.Bucket {
+  s := sessions.Bucket([]byte(id))
+  if s == nil || boltExpired(s, now) {
+    return nil
+  }
+  return s
+}
+
+//boltCreateSession returns the id's bucket, replacing it with
+//an empty one if its grace period is over
+func boltCreateSession(sessions *bbolt.Bucket, id string, now time.Time) (*bbolt.Bucket, error) {
+  if s := sessions.Bucket([]byte(id)); s != nil && boltExpired(s, now) {
+    if err := sessions.DeleteBucket([]byte(id)); err != nil {
+      return nil, err
+    }
+  }
+  return sessions.CreateBucketIfNotExists([]byte(id))
+}
+
+//boltExpired reports whether the grace period of the session s
+//is over
+func boltExpired(s *bbolt.Bucket, now time.Time) bool {
+  v := s.Get([]byte(sessionExpiresField))
+  if v == nil {
+    return false
+  }
+  deadline, _ := strconv.ParseInt(string(v), 10, 64)
+  return deadline <= now.UnixNano() / int64(time.Millisecond)
+}
+
+//boltRetire keeps the old id's session s until deadline, or
+//its earlier deadline if it already has one
+func boltRetire(tx *bbolt.Tx, s *bbolt.Bucket, id string, deadline time.Time) error {
+  d := deadline.UnixNano() / int64(time.Millisecond)
+  if v := s.Get([]byte(sessionExpiresField)); v != nil {
+    if cur, _ := strconv.ParseInt(string(v), 10, 64); cur <= d {
+      return nil
+    }
+  }
+  if err := s.Put([]byte(sessionExpiresField), []byte(strconv.FormatInt(d, 10))); err != nil {
+    return err
+  }
+  k := make([]byte, 8, 8 + len(id))
+  binary.BigEndian.PutUint64(k, uint64(d))
+  return tx.Bucket(boltRetiredBucket).Put(append(k, id...), nil)
+}
+
+//boltRemoveRetired removes the sessions of the old ids whose
+//grace period is over
+func boltRemoveRetired(tx *bbolt.Tx, now time.Time) error {
+  retired := tx.Bucket(boltRetiredBucket)
+  sessions := tx.Bucket(boltSessionsBucket)
+  ms := uint64(now.UnixNano() / int64(time.Millisecond))
+  done := [][]byte{}
+  c := retired.Cursor()
+  for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= ms; k, _ = c.Next() {
+    done = append(done, append([]byte(nil), k...))
+  }
+  for _, k := range done {
+    id := k[8:]
+    if s := sessions.Bucket(id); s != nil && boltExpired(s, now) {
+      if err := sessions.DeleteBucket(id); err != nil {
+        return err
+      }
+    }
+    if err := retired.Delete(k); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+//MapSessionIds links the session prodId to the staging session
+//stagingId, replacing any older link of either id in the same
+//transaction
+func (b *BoltCache) MapSessionIds(prodId string, stagingId string) error {
+  return b.db.Update(func(tx *bbolt.Tx) error {
+    prod := tx.Bucket(boltProdBucket)
+    staging := tx.Bucket(boltStagingBucket)
+    if old := prod.Get([]byte(prodId)); old != nil && string(old) != stagingId {
+      if err := staging.Delete(old); err != nil {
+        return err
+      }
+    }
+    if old := staging.Get([]byte(stagingId)); old != nil && string(old) != prodId {
+      if err := prod.Delete(old); err != nil {
+        return err
+      }
+    }
+    if err := prod.Put([]byte(prodId), []byte(stagingId)); err != nil {
+      return err
+    }
+    return staging.Put([]byte(stagingId), []byte(prodId))
+  })
+}
+
+//StagingSessionId returns the staging session id linked to
+//prodId
+func (b *BoltCache) StagingSessionId(prodId string) (string, error) {
+  return b.linkedId(boltProdBucket, prodId)
+}
+
+//ProdSessionId returns the session id linked to stagingId
+func (b *BoltCache) ProdSessionId(stagingId string) (string, error) {
+  return b.linkedId(boltStagingBucket, stagingId)
+}
+
+func (b *BoltCache) linkedId(bucket []byte, id string) (string, error) {
+  var v string
+  err := b.db.View(func(tx *bbolt.Tx) error {
+    l := tx.Bucket(bucket).Get([]byte(id))
+    if l == nil {
+      return ErrNoId
+    }
+    v = string(l)
+    return nil
+  })
+  return v, err
+}
+
+//Close closes the file.  The cache can not be used afterwards
+func (b *BoltCache) Close() error {
+  return b.db.Close()
+}
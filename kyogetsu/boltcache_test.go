@@ -0,0 +1,203 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "go.etcd.io/bbolt"
+  "net/http"
+  "path/filepath"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+  )
+
+func getBoltCache(t *testing.T) (*BoltCache, string) {
+  path := filepath.Join(t.TempDir(), "cookies.db")
+  b, err := NewBoltCache(path, time.Second)
+  if err != nil {
+    t.Fatalf("Unexpected Error: %s", err)
+  }
+  return b, path
+}
+
+func boltCookieNames(t *testing.T, b *BoltCache, id string) string {
+  c, err := b.GetCookies(id)
+  if err != nil {
+    t.Fatalf("Unexpected Error: %s", err)
+  }
+  names := []string{}
+  for _, v := range c {
+    names = append(names, v.Name + "=" + v.Value)
+  }
+  sort.Strings(names)
+  return strings.Join(names, ",")
+}
+
+func TestBoltCacheSetGet(t *testing.T) {
+  b, _ := getBoltCache(t)
+  defer b.Close()
+  expires := time.Unix(2000000000, 0)
+  b.SetCookie("bill", &http.Cookie{Name: "type", Value: "test", Path: "/app",
+                                    HttpOnly: true, Expires: expires})
+  b.SetCookies("bill", []*http.Cookie{
+    &http.Cookie{Name: "name", Value: "bill"},
+  })
+
+  c, err := b.GetCookie("bill", "type")
+  if err != nil {
+    t.Fatalf("Unexpected Error: %s", err)
+  }
+  if c.Value != "test" || c.Path != "/app" || !c.HttpOnly || !c.Expires.Equal(expires) {
+    t.Errorf("Attributes were not kept: %v", c)
+  }
+  if _, err = b.GetCookie("bill", "missing"); err != ErrCookieNotFound {
+    t.Errorf("Expected: %s Got: %v", ErrCookieNotFound, err)
+  }
+  if _, err = b.GetCookie("nobody", "type"); err != ErrCookieNotFound {
+    t.Errorf("Expected: %s Got: %v", ErrCookieNotFound, err)
+  }
+  if n := boltCookieNames(t, b, "bill"); n != "name=bill,type=test" {
+    t.Errorf("Expected: name=bill,type=test Got: %s", n)
+  }
+  if n := boltCookieNames(t, b, "nobody"); n != "" {
+    t.Errorf("Expected no cookies Got: %s", n)
+  }
+}
+
+func TestBoltCacheDeleteAndChangeId(t *testing.T) {
+  b, _ := getBoltCache(t)
+  defer b.Close()
+  b.SetChangeIdPolicy(OldIdWins, 0)
+  b.SetCookies("bill", []*http.Cookie{
+    &http.Cookie{Name: "a", Value: "1"},
+    &http.Cookie{Name: "b", Value: "2"},
+  })
+  b.SetCookie("bob", &http.Cookie{Name: "old", Value: "data"})
+  b.DeleteCookie("bill", "a")
+
+  if err := b.ChangeCookiesId("bill", "bob"); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if n := boltCookieNames(t, b, "bob"); n != "b=2,old=data" {
+    t.Errorf("Expected: b=2,old=data Got: %s", n)
+  }
+  if n := boltCookieNames(t, b, "bill"); n != "" {
+    t.Errorf("The old id still has cookies: %s", n)
+  }
+  if err := b.ChangeCookiesId("missing", "other"); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+
+  b.DeleteCookies("bob", []string{"b", "old"})
+  b.ChangeCookiesId("bob", "other")
+  b.db.View(func(tx *bbolt.Tx) error {
+    for _, id := range []string{"bob", "other"} {
+      if tx.Bucket(boltSessionsBucket).Bucket([]byte(id)) != nil {
+        t.Errorf("An emptied session should be removed, %s still exists", id)
+      }
+    }
+    return nil
+  })
+}
+
+func TestBoltCacheChangeIdMerge(t *testing.T) {
+  tests := []struct {
+    Policy IdConflictPolicy
+    Err error
+    Bob string
+    Bill string
+  } {
+    {OldIdWins, nil, "newonly=2,oldonly=1,shared=old", ""},
+    {NewIdWins, nil, "newonly=2,oldonly=1,shared=new", ""},
+    {FailOnConflict, ErrIdConflict, "newonly=2,shared=new", "oldonly=1,shared=old"},
+  }
+  for _, test := range tests {
+    b, _ := getBoltCache(t)
+    b.SetChangeIdPolicy(test.Policy, 0)
+    b.SetCookies("bill", []*http.Cookie{
+      &http.Cookie{Name: "shared", Value: "old"},
+      &http.Cookie{Name: "oldonly", Value: "1"},
+    })
+    b.SetCookies("bob", []*http.Cookie{
+      &http.Cookie{Name: "shared", Value: "new"},
+      &http.Cookie{Name: "newonly", Value: "2"},
+    })
+
+    if err := b.ChangeCookiesId("bill", "bob"); err != test.Err {
+      t.Errorf("Policy %d Expected: %v Got: %v", test.Policy, test.Err, err)
+    }
+    if n := boltCookieNames(t, b, "bob"); n != test.Bob {
+      t.Errorf("Policy %d Expected: %s Got: %s", test.Policy, test.Bob, n)
+    }
+    if n := boltCookieNames(t, b, "bill"); n != test.Bill {
+      t.Errorf("Policy %d Old id Expected: %s Got: %s", test.Policy, test.Bill, n)
+    }
+    b.Close()
+  }
+}
+
+func TestBoltCacheChangeIdGrace(t *testing.T) {
+  b, _ := getBoltCache(t)
+  defer b.Close()
+  clock := &testClock{time.Unix(1500000000, 0)}
+  b.now = clock.Now
+  b.SetCookie("bill", &http.Cookie{Name: "a", Value: "1"})
+  if err := b.ChangeCookiesId("bill", "bob"); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if n := boltCookieNames(t, b, "bob"); n != "a=1" {
+    t.Errorf("Expected: a=1 Got: %s", n)
+  }
+  clock.t = clock.t.Add(DefaultOldIdGrace / 2)
+  if n := boltCookieNames(t, b, "bill"); n != "a=1" {
+    t.Errorf("The old id should work during the grace period Got: %s", n)
+  }
+  //a write during the grace period does not extend it
+  b.SetCookie("bill", &http.Cookie{Name: "b", Value: "2"})
+
+  clock.t = clock.t.Add(DefaultOldIdGrace / 2)
+  if _, err := b.GetCookie("bill", "a"); err != ErrCookieNotFound {
+    t.Errorf("Expected the old id to expire after the grace period Got: %v", err)
+  }
+  //the next change removes the expired session from the file
+  b.ChangeCookiesId("other", "another")
+  b.db.View(func(tx *bbolt.Tx) error {
+    if tx.Bucket(boltSessionsBucket).Bucket([]byte("bill")) != nil {
+      t.Error("The expired old id is still stored")
+    }
+    if k, _ := tx.Bucket(boltRetiredBucket).Cursor().First(); k != nil {
+      t.Errorf("The expired old id is still listed: %q", k)
+    }
+    return nil
+  })
+}
+
+func TestBoltCacheSurvivesRestart(t *testing.T) {
+  b, path := getBoltCache(t)
+  b.SetCookie("bill", &http.Cookie{Name: "session", Value: "abc"})
+  b.ChangeCookiesId("bill", "william")
+  if err := b.Close(); err != nil {
+    t.Fatalf("Unexpected Error: %s", err)
+  }
+
+  b, err := NewBoltCache(path, time.Second)
+  if err != nil {
+    t.Fatalf("Unexpected Error: %s", err)
+  }
+  defer b.Close()
+  if n := boltCookieNames(t, b, "william"); n != "session=abc" {
+    t.Errorf("Expected: session=abc Got: %s", n)
+  }
+}
+
+func TestBoltCacheLocked(t *testing.T) {
+  b, path := getBoltCache(t)
+  defer b.Close()
+  if _, err := NewBoltCache(path, 10 * time.Millisecond); err == nil {
+    t.Error("Opened a file that is already in use")
+  }
+}
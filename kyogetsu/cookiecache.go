@@ -6,7 +6,12 @@
 package kyogetsu
 
 import (
+  "encoding/json"
+  "errors"
+  "net"
   "net/http"
+  "strings"
+  "time"
 )
 
 //A CookiesCache represents an interface to a data
@@ -25,7 +30,142 @@ type CookieCache interface {
   //Gets all cookie data for a given user session
   GetCookies(id string) ([]*http.Cookie, error)
 
+  //Removes a single cookie from the session
+  DeleteCookie(id string, key string) error
+  //Removes the named cookies from the session
+  DeleteCookies(id string, keys []string) error
+
   //Change the Id that the cookie data is stored under
   ChangeCookiesId(old_id string, new_id string) error
 }
 
+//IdConflictPolicy decides what ChangeCookiesId does with a
+//cookie that is stored under both the old and the new id.
+//RedisCache, MemoryCache and BoltCache all merge the old id's
+//cookies into the new id with it and keep the old id for a
+//grace period, both set with their SetChangeIdPolicy
+type IdConflictPolicy int
+
+const (
+  //OldIdWins keeps the cookie from the old id
+  OldIdWins IdConflictPolicy = iota
+  //NewIdWins keeps the cookie already stored under the new id
+  NewIdWins
+  //FailOnConflict leaves both ids untouched and returns
+  //ErrIdConflict
+  FailOnConflict
+)
+
+//DefaultOldIdGrace is how long the old id keeps its cookies
+//after ChangeCookiesId, so staging requests already in flight
+//with it still find them, until SetChangeIdPolicy is called
+const DefaultOldIdGrace = 30 * time.Second
+
+//ErrIdConflict is returned by ChangeCookiesId when the
+//FailOnConflict policy finds a cookie under both ids
+var ErrIdConflict = errors.New("cookie is stored under both ids")
+
+//cookieDeleted reports whether a Set-Cookie for c asks the
+//browser to remove it, with a Max-Age of zero or less or an
+//Expires in the past
+func cookieDeleted(c *http.Cookie, now time.Time) bool {
+  return c.MaxAge < 0 || cookieExpired(c, now)
+}
+
+
+//storedCookie is the serialized form of an http.Cookie used by
+//the CookieCaches.  MaxAge is turned into Expires when the
+//cookie is stored, so it keeps its meaning when read back
+type storedCookie struct {
+  Name string
+  Value string
+  Path string `json:",omitempty"`
+  Domain string `json:",omitempty"`
+  Expires int64 `json:",omitempty"`
+  Secure bool `json:",omitempty"`
+  HttpOnly bool `json:",omitempty"`
+  SameSite http.SameSite `json:",omitempty"`
+}
+
+//encodeCookie serializes c with all of its attributes
+func encodeCookie(c *http.Cookie, now time.Time) string {
+  sc := storedCookie{
+    Name: c.Name,
+    Value: c.Value,
+    Path: c.Path,
+    Domain: c.Domain,
+    Secure: c.Secure,
+    HttpOnly: c.HttpOnly,
+    SameSite: c.SameSite,
+  }
+  if c.MaxAge > 0 {
+    sc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second).Unix()
+  } else if !c.Expires.IsZero() {
+    sc.Expires = c.Expires.Unix()
+  }
+  b, _ := json.Marshal(sc)
+  return string(b)
+}
+
+//decodeCookie reads a cookie stored by encodeCookie.  Values
+//stored before attributes were kept are plain cookie values,
+//which can never start with {" so they are returned as is
+func decodeCookie(name string, v string) *http.Cookie {
+  var sc storedCookie
+  if isLegacyCookie(v) || json.Unmarshal([]byte(v), &sc) != nil {
+    return &http.Cookie{Name: name, Value: v}
+  }
+  c := &http.Cookie{
+    Name: sc.Name,
+    Value: sc.Value,
+    Path: sc.Path,
+    Domain: sc.Domain,
+    Secure: sc.Secure,
+    HttpOnly: sc.HttpOnly,
+    SameSite: sc.SameSite,
+  }
+  if sc.Expires != 0 {
+    c.Expires = time.Unix(sc.Expires, 0)
+  }
+  return c
+}
+
+//isLegacyCookie reports whether v was stored as a plain value
+func isLegacyCookie(v string) bool {
+  return !strings.HasPrefix(v, `{"`)
+}
+
+//cookieExpired reports whether c has expired at now
+func cookieExpired(c *http.Cookie, now time.Time) bool {
+  return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+//cookieMatches reports whether c should be sent to host with a
+//request for path, using the domain and path matching rules of
+//RFC 6265.  Cookies without a Domain match any host
+func cookieMatches(c *http.Cookie, host string, p string) bool {
+  if c.Domain != "" {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+      host = h
+    }
+    host = strings.ToLower(host)
+    d := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+    if host != "" && host != d && !strings.HasSuffix(host, "." + d) {
+      return false
+    }
+  }
+  if c.Path != "" {
+    if p == "" {
+      p = "/"
+    }
+    if p != c.Path {
+      if !strings.HasPrefix(p, c.Path) {
+        return false
+      }
+      if !strings.HasSuffix(c.Path, "/") && p[len(c.Path)] != '/' {
+        return false
+      }
+    }
+  }
+  return true
+}
@@ -0,0 +1,85 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "testing"
+  "time"
+  )
+
+func TestEncodeDecodeCookie(t *testing.T) {
+  now := time.Unix(1500000000, 0)
+  tests := []struct {
+    In *http.Cookie
+    Expires time.Time
+  } {
+    {&http.Cookie{Name: "a", Value: "b"}, time.Time{}},
+    {&http.Cookie{Name: "session", Value: "xyz", Path: "/app", Domain: ".example.com",
+                  Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode,
+                  Expires: now.Add(time.Hour)}, now.Add(time.Hour)},
+    {&http.Cookie{Name: "short", Value: "lived", MaxAge: 60}, now.Add(time.Minute)},
+  }
+  for _, test := range tests {
+    c := decodeCookie(test.In.Name, encodeCookie(test.In, now))
+    if c.Name != test.In.Name || c.Value != test.In.Value || c.Path != test.In.Path ||
+       c.Domain != test.In.Domain || c.Secure != test.In.Secure ||
+       c.HttpOnly != test.In.HttpOnly || c.SameSite != test.In.SameSite {
+      t.Errorf("Expected: %v Got: %v", test.In, c)
+    }
+    if !c.Expires.Equal(test.Expires) {
+      t.Errorf("%s: Expires Expected: %s Got: %s", c.Name, test.Expires, c.Expires)
+    }
+  }
+}
+
+func TestDecodeLegacyCookie(t *testing.T) {
+  for _, v := range []string{"plain", "", "{notjson"} {
+    c := decodeCookie("name", v)
+    if c.Name != "name" || c.Value != v {
+      t.Errorf("Expected: name=%s Got: %s=%s", v, c.Name, c.Value)
+    }
+  }
+}
+
+func TestCookieMatches(t *testing.T) {
+  tests := []struct {
+    Cookie *http.Cookie
+    URL string
+    Matches bool
+  } {
+    {&http.Cookie{Name: "a"}, "http://anything.com/any/path", true},
+    {&http.Cookie{Name: "a", Domain: "example.com"}, "http://example.com/", true},
+    {&http.Cookie{Name: "a", Domain: ".example.com"}, "http://www.example.com:8080/", true},
+    {&http.Cookie{Name: "a", Domain: "example.com"}, "http://badexample.com/", false},
+    {&http.Cookie{Name: "a", Domain: "other.com"}, "http://example.com/", false},
+    {&http.Cookie{Name: "a", Path: "/app"}, "http://example.com/app", true},
+    {&http.Cookie{Name: "a", Path: "/app"}, "http://example.com/app/page", true},
+    {&http.Cookie{Name: "a", Path: "/app/"}, "http://example.com/app/page", true},
+    {&http.Cookie{Name: "a", Path: "/app"}, "http://example.com/apple", false},
+    {&http.Cookie{Name: "a", Path: "/app"}, "http://example.com/", false},
+    {&http.Cookie{Name: "a", Path: "/"}, "http://example.com", true},
+  }
+  for _, test := range tests {
+    r, _ := http.NewRequest("GET", test.URL, nil)
+    if got := cookieMatches(test.Cookie, r.URL.Host, r.URL.Path); got != test.Matches {
+      t.Errorf("%v on %s: Expected: %t Got: %t", test.Cookie, test.URL, test.Matches, got)
+    }
+  }
+}
+
+func TestCookieExpired(t *testing.T) {
+  now := time.Now()
+  if cookieExpired(&http.Cookie{Name: "a"}, now) {
+    t.Error("A session cookie should never expire")
+  }
+  if cookieExpired(&http.Cookie{Name: "a", Expires: now.Add(time.Minute)}, now) {
+    t.Error("A cookie expiring in the future is not expired")
+  }
+  if !cookieExpired(&http.Cookie{Name: "a", Expires: now.Add(-time.Minute)}, now) {
+    t.Error("A cookie that expired in the past should be expired")
+  }
+}
@@ -0,0 +1,125 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "path"
+  "strings"
+)
+
+//ignoredCookie reports whether name matches one of the ignored
+//cookie patterns.  Patterns use path.Match syntax, so "_ga*"
+//ignores every cookie starting with _ga
+func (p KyogetsuProxy) ignoredCookie(name string) bool {
+  for _, pat := range p.ignoredCookies {
+    if ok, _ := path.Match(pat, name); ok {
+      return true
+    }
+  }
+  return false
+}
+
+//CookieMode decides how loadCookies combines the cookies
+//cached for staging with the ones the client sent
+type CookieMode int
+
+const (
+  //ReplaceCookies sends staging only the cached cookies
+  ReplaceCookies CookieMode = iota
+  //MergeCookies sends the cached cookies and the client's
+  //cookies that staging has not set, so cookies such as
+  //analytics or consent flags reach staging too.  A cached
+  //cookie overrides a client cookie with the same name
+  MergeCookies
+)
+
+//clientCookies returns the cookies of r that the ClientCookies
+//allowlist lets through to staging
+func (p KyogetsuProxy) clientCookies(r *http.Request) []*http.Cookie {
+  c := r.Cookies()
+  if len(p.opts.ClientCookies) == 0 {
+    return c
+  }
+  f := make([]*http.Cookie, 0, len(c))
+  for _, v := range c {
+    for _, pat := range p.opts.ClientCookies {
+      if ok, _ := path.Match(pat, v.Name); ok {
+        f = append(f, v)
+        break
+      }
+    }
+  }
+  return f
+}
+
+//filterCookies returns the cookies in c that are not ignored
+func (p KyogetsuProxy) filterCookies(c []*http.Cookie) []*http.Cookie {
+  if len(p.ignoredCookies) == 0 {
+    return c
+  }
+  f := make([]*http.Cookie, 0, len(c))
+  for _, v := range c {
+    if !p.ignoredCookie(v.Name) {
+      f = append(f, v)
+    }
+  }
+  return f
+}
+
+//stripRequestCookies returns a copy of h without the ignored
+//cookies in its Cookie header
+func (p KyogetsuProxy) stripRequestCookies(h http.Header) http.Header {
+  if _, ok := h["Cookie"]; !ok {
+    return h
+  }
+  c := p.filterCookies((&http.Request{Header: h}).Cookies())
+  h = h.Clone()
+  h.Del("Cookie")
+  if len(c) > 0 {
+    s := make([]string, len(c))
+    for i, v := range c {
+      s[i] = v.Name + "=" + v.Value
+    }
+    h.Set("Cookie", strings.Join(s, "; "))
+  }
+  return h
+}
+
+//stripResponseCookies returns a copy of h without the
+//Set-Cookie lines of ignored cookies
+func (p KyogetsuProxy) stripResponseCookies(h http.Header) http.Header {
+  if _, ok := h["Set-Cookie"]; !ok {
+    return h
+  }
+  h = h.Clone()
+  kept := h["Set-Cookie"][:0]
+  for _, line := range h["Set-Cookie"] {
+    c := (&http.Response{Header: http.Header{"Set-Cookie": {line}}}).Cookies()
+    if len(c) == 1 && p.ignoredCookie(c[0].Name) {
+      continue
+    }
+    kept = append(kept, line)
+  }
+  if len(kept) == 0 {
+    h.Del("Set-Cookie")
+  } else {
+    h["Set-Cookie"] = kept
+  }
+  return h
+}
+
+//sendMessage removes the ignored cookies from m if the proxy
+//is set to strip them, then sends it to the MessageSender
+func (p KyogetsuProxy) sendMessage(m *Message) error {
+  if p.opts.StripIgnoredCookies && len(p.ignoredCookies) > 0 {
+    m.ProdRequest.Header = p.stripRequestCookies(m.ProdRequest.Header)
+    m.StagingRequest.Header = p.stripRequestCookies(m.StagingRequest.Header)
+    m.ProdReponse.Header = p.stripResponseCookies(m.ProdReponse.Header)
+    m.StagingReponse.Header = p.stripResponseCookies(m.StagingReponse.Header)
+  }
+  return p.ms.SendMessage(m)
+}
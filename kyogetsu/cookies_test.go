@@ -0,0 +1,255 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+  )
+
+func newIgnoringProxy(c CookieCache, ms MessageSender, strip bool) KyogetsuProxy {
+  return NewKyogetsuProxyWithOptions(SingleProxyHandler{}, ms, c, CookieIdFunction("id"), Options{
+    IgnoredCookies: []string{"_ga*", "consent"},
+    StripIgnoredCookies: strip,
+  })
+}
+
+func TestIgnoredCookie(t *testing.T) {
+  k := newIgnoringProxy(getMemoryCache(), dummySender{}, false)
+  tests := []struct {
+    Name string
+    Ignored bool
+  } {
+    {"_ga", true},
+    {"_gat_UA", true},
+    {"consent", true},
+    {"consented", false},
+    {"id", false},
+  }
+  for _, test := range tests {
+    if k.ignoredCookie(test.Name) != test.Ignored {
+      t.Errorf("%s: Expected: %t Got: %t", test.Name, test.Ignored, !test.Ignored)
+    }
+  }
+}
+
+func TestSaveCookiesSkipsIgnored(t *testing.T) {
+  fc := getMemoryCache()
+  k := newIgnoringProxy(fc, dummySender{}, false)
+  w := httptest.NewRecorder()
+  http.SetCookie(w, &http.Cookie{Name: "_ga", Value: "GA1.2"})
+  http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+  k.saveCookies("bob", w)
+
+  c, _ := fc.GetCookies("bob")
+  if len(c) != 1 || c[0].Name != "session" {
+    t.Errorf("Expected only the session cookie to be saved Got: %v", c)
+  }
+}
+
+func TestLoadCookiesSkipsIgnored(t *testing.T) {
+  fc := getMemoryCache()
+  fc.SetCookies("bob", []*http.Cookie{
+    &http.Cookie{Name: "consent", Value: "yes"},
+    &http.Cookie{Name: "session", Value: "abc"},
+  })
+  k := newIgnoringProxy(fc, dummySender{}, false)
+  r := newTestRequest()
+  k.loadCookies("bob", r.URL.Host, r)
+
+  c := r.Cookies()
+  if len(c) != 1 || c[0].Name != "session" {
+    t.Errorf("Expected only the session cookie to be loaded Got: %v", c)
+  }
+}
+
+func TestSendMessageStripsIgnored(t *testing.T) {
+  ms := make(chanSender, 1)
+  k := newIgnoringProxy(getMemoryCache(), ms, true)
+  reqH := http.Header{"Cookie": {"_ga=1; id=bob; consent=yes"}}
+  respH := http.Header{"Set-Cookie": {"_gat=2; Path=/", "id=bill"}}
+  k.sendMessage(&Message{
+    ProdRequest: RequestInfo{Header: reqH},
+    ProdReponse: ResponseInfo{Header: respH},
+  })
+  m := <-ms
+
+  if h := m.ProdRequest.Header.Get("Cookie"); h != "id=bob" {
+    t.Errorf("Expected: id=bob Got: %s", h)
+  }
+  if h := m.ProdReponse.Header["Set-Cookie"]; len(h) != 1 || h[0] != "id=bill" {
+    t.Errorf("Expected: [id=bill] Got: %v", h)
+  }
+  if reqH.Get("Cookie") != "_ga=1; id=bob; consent=yes" || len(respH["Set-Cookie"]) != 2 {
+    t.Error("Stripping changed the original headers")
+  }
+}
+
+func TestLoadCookiesMatchesRequest(t *testing.T) {
+  fc := getMemoryCache()
+  fc.SetCookies("bob", []*http.Cookie{
+    &http.Cookie{Name: "root", Value: "1", Path: "/"},
+    &http.Cookie{Name: "admin", Value: "2", Path: "/admin"},
+    &http.Cookie{Name: "other", Value: "3", Domain: "other.com"},
+    &http.Cookie{Name: "expired", Value: "4", Expires: time.Now().Add(-time.Hour)},
+    &http.Cookie{Name: "domain", Value: "5", Domain: "example.com"},
+  })
+  k := NewKyogetsuProxy(SingleProxyHandler{}, dummySender{}, fc, CookieIdFunction("id"))
+  tests := []struct {
+    URL string
+    Expected []string
+  } {
+    {"http://www.example.com/", []string{"domain", "root"}},
+    {"http://www.example.com/admin/users", []string{"admin", "domain", "root"}},
+  }
+  for _, test := range tests {
+    r, _ := http.NewRequest("GET", test.URL, nil)
+    k.loadCookies("bob", r.URL.Host, r)
+    names := []string{}
+    for _, c := range r.Cookies() {
+      names = append(names, c.Name)
+    }
+    sort.Strings(names)
+    if strings.Join(names, ",") != strings.Join(test.Expected, ",") {
+      t.Errorf("%s: Expected: %v Got: %v", test.URL, test.Expected, names)
+    }
+  }
+}
+
+func TestSaveCookiesDeletesCookies(t *testing.T) {
+  fc := getMemoryCache()
+  fc.SetCookies("bob", []*http.Cookie{
+    &http.Cookie{Name: "session", Value: "abc"},
+    &http.Cookie{Name: "remember", Value: "yes"},
+    &http.Cookie{Name: "theme", Value: "dark"},
+  })
+  k := NewKyogetsuProxy(SingleProxyHandler{}, dummySender{}, fc, CookieIdFunction("id"))
+
+  w := httptest.NewRecorder()
+  w.Header().Add("Set-Cookie", "session=; Max-Age=0")
+  w.Header().Add("Set-Cookie", "remember=; Expires=Thu, 01 Jan 1970 00:00:00 GMT")
+  w.Header().Add("Set-Cookie", "theme=light")
+  k.saveCookies("bob", w)
+
+  c, _ := fc.GetCookies("bob")
+  if len(c) != 1 || c[0].Name != "theme" || c[0].Value != "light" {
+    t.Errorf("Expected: [theme=light] Got: %v", c)
+  }
+}
+
+//cookieString returns the cookies of r as sorted name=value pairs
+func cookieString(r *http.Request) string {
+  s := []string{}
+  for _, v := range r.Cookies() {
+    s = append(s, v.Name + "=" + v.Value)
+  }
+  sort.Strings(s)
+  return strings.Join(s, "; ")
+}
+
+func TestLoadCookiesMerge(t *testing.T) {
+  tests := []struct {
+    Mode CookieMode
+    Allow []string
+    Expected string
+  } {
+    {ReplaceCookies, nil, "id=staging; session=abc"},
+    {ReplaceCookies, []string{"ab_*"}, "id=staging; session=abc"},
+    {MergeCookies, nil, "ab_test=b; consent=yes; id=staging; session=abc; theme=dark"},
+    {MergeCookies, []string{"ab_*", "theme", "id"}, "ab_test=b; id=staging; session=abc; theme=dark"},
+  }
+  for _, test := range tests {
+    fc := getMemoryCache()
+    fc.SetCookies("bob", []*http.Cookie{
+      &http.Cookie{Name: "id", Value: "staging"},
+      &http.Cookie{Name: "session", Value: "abc"},
+    })
+    k := NewKyogetsuProxyWithOptions(SingleProxyHandler{}, dummySender{}, fc, CookieIdFunction("id"), Options{
+      CookieMode: test.Mode,
+      ClientCookies: test.Allow,
+    })
+    r := newTestRequest()
+    r.Header.Set("Cookie", "id=bob; ab_test=b; consent=yes; theme=dark")
+    k.loadCookies("bob", r.URL.Host, r)
+
+    if c := cookieString(r); c != test.Expected {
+      t.Errorf("Mode %d %v: Expected: %s Got: %s", test.Mode, test.Allow, test.Expected, c)
+    }
+  }
+}
+
+func TestHandleStagingClientCookiesWithoutId(t *testing.T) {
+  ss := newStagingServer()
+  defer ss.Close()
+  ms := make(chanSender, 1)
+  ph := NewSingleProxyHandler(ss.URL, ss.URL)
+  k := NewKyogetsuProxyWithOptions(ph, ms, getMemoryCache(), CookieIdFunction("id"), Options{
+    ClientCookies: []string{"theme"},
+  })
+
+  r, _ := http.NewRequest("GET", ss.URL + "/", nil)
+  r.Header.Set("Cookie", "ab_test=b; theme=dark")
+  k.HandleStaging(r, httptest.NewRecorder())
+
+  m := waitMessage(t, ms)
+  if c := m.StagingRequest.Header.Get("Cookie"); c != "theme=dark" {
+    t.Errorf("Expected: theme=dark Got: %s", c)
+  }
+  if c := m.ProdRequest.Header.Get("Cookie"); c != "ab_test=b; theme=dark" {
+    t.Errorf("The production request was changed: %s", c)
+  }
+}
+
+func TestServeHTTPKeepsStagingHost(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+  type seen struct {
+    Host string
+    Cookies string
+  }
+  got := make(chan seen, 1)
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got <- seen{r.Host, cookieString(r)}
+  }))
+  defer ss.Close()
+  stagingHost := strings.TrimPrefix(ss.URL, "http://")
+
+  tests := []struct {
+    CookieHost string
+    Expected string
+  } {
+    {"", "id=bob; own=1"},
+    {"www.example.com", "id=bob; prod=2"},
+  }
+  for _, test := range tests {
+    fc := getMemoryCache()
+    fc.SetCookies("bob", []*http.Cookie{
+      &http.Cookie{Name: "id", Value: "bob"},
+      &http.Cookie{Name: "own", Value: "1", Domain: "127.0.0.1"},
+      &http.Cookie{Name: "prod", Value: "2", Domain: "example.com"},
+    })
+    ms := make(chanSender, 1)
+    k := NewKyogetsuProxyWithOptions(NewSingleProxyHandler(ps.URL, ss.URL), ms, fc, CookieIdFunction("id"),
+                                     Options{StagingCookieHost: test.CookieHost})
+    r := httptest.NewRequest("GET", "/", nil)
+    r.Host = "www.example.com"
+    r.AddCookie(&http.Cookie{Name: "id", Value: "bob"})
+    k.ServeHTTP(httptest.NewRecorder(), r)
+    waitMessage(t, ms)
+
+    s := <-got
+    if s.Host != stagingHost {
+      t.Errorf("%q: Host Expected: %s Got: %s", test.CookieHost, stagingHost, s.Host)
+    }
+    if s.Cookies != test.Expected {
+      t.Errorf("%q: Cookies Expected: %s Got: %s", test.CookieHost, test.Expected, s.Cookies)
+    }
+  }
+}
@@ -0,0 +1,196 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "sort"
+  "strings"
+)
+
+//DiffResult is the verdict of comparing the production and
+//staging responses of a Message
+type DiffResult struct {
+  //Match is true if no difference was found
+  Match bool
+  //StatusMismatch is true if the status codes differ
+  StatusMismatch bool
+  ProdStatus int
+  StagingStatus int
+  //Headers lists the headers whose values differ
+  Headers []HeaderDiff
+  //Body lists the differences between the bodies
+  Body []BodyDiff
+}
+
+//HeaderDiff is a header whose values differ, a header missing
+//from one side has no values there
+type HeaderDiff struct {
+  Name string
+  Prod []string
+  Staging []string
+}
+
+//BodyDiff is a difference between the bodies.  Path says where
+//it is, its format depends on the BodyComparator
+type BodyDiff struct {
+  Path string
+  Prod string
+  Staging string
+}
+
+//A Comparator compares the production and staging responses
+//to the request r.  When the proxy has one, every Message with
+//a staging response carries its DiffResult
+type Comparator interface {
+  Compare(r *http.Request, prod ResponseInfo, staging ResponseInfo) *DiffResult
+}
+
+//A BodyComparator lists the differences between the bodies of
+//two responses
+type BodyComparator interface {
+  CompareBodies(prod ResponseInfo, staging ResponseInfo) []BodyDiff
+}
+
+//DefaultIgnoredHeaders are the headers a ResponseComparator
+//skips when its IgnoreHeaders is nil, as they differ on every
+//response
+var DefaultIgnoredHeaders = []string{
+  "Age", "Content-Length", "Date", "Etag", "Expires", "Last-Modified",
+  "Set-Cookie", "X-Request-Id",
+}
+
+//ResponseComparator is the built in Comparator.  It compares
+//the status codes, the headers other than IgnoreHeaders, and
+//the bodies with Body.  A nil IgnoreHeaders uses
+//DefaultIgnoredHeaders and a nil Body compares the bodies line
+//by line with TextComparator
+type ResponseComparator struct {
+  IgnoreHeaders []string
+  Body BodyComparator
+}
+
+//Compare compares the two responses
+func (c ResponseComparator) Compare(r *http.Request, prod ResponseInfo, staging ResponseInfo) *DiffResult {
+  d := &DiffResult{ProdStatus: prod.Status, StagingStatus: staging.Status}
+  d.StatusMismatch = prod.Status != staging.Status
+
+  ignore := c.IgnoreHeaders
+  if ignore == nil {
+    ignore = DefaultIgnoredHeaders
+  }
+  d.Headers = compareHeaders(prod.Header, staging.Header, ignore)
+
+  b := c.Body
+  if b == nil {
+    b = TextComparator{}
+  }
+  d.Body = b.CompareBodies(prod, staging)
+  d.Match = !d.StatusMismatch && len(d.Headers) == 0 && len(d.Body) == 0
+  return d
+}
+
+//capBody returns ri with its body cut to at most limit bytes,
+//so it can be compared with a production body that was cut at
+//the same limit.  A negative limit keeps the whole body
+func capBody(ri ResponseInfo, limit int64) ResponseInfo {
+  if limit >= 0 && int64(len(ri.Body)) > limit {
+    ri.Body = ri.Body[:limit]
+  }
+  return ri
+}
+
+//compareHeaders lists the headers that differ between p and s,
+//ordered by name
+func compareHeaders(p http.Header, s http.Header, ignore []string) []HeaderDiff {
+  skip := map[string]bool{}
+  for _, h := range ignore {
+    skip[http.CanonicalHeaderKey(h)] = true
+  }
+  names := map[string]bool{}
+  for k := range p {
+    names[http.CanonicalHeaderKey(k)] = true
+  }
+  for k := range s {
+    names[http.CanonicalHeaderKey(k)] = true
+  }
+
+  d := []HeaderDiff{}
+  for k := range names {
+    if skip[k] {
+      continue
+    }
+    pv, sv := p.Values(k), s.Values(k)
+    if strings.Join(pv, "\n") != strings.Join(sv, "\n") || len(pv) != len(sv) {
+      d = append(d, HeaderDiff{Name: k, Prod: pv, Staging: sv})
+    }
+  }
+  sort.Slice(d, func(i, j int) bool { return d[i].Name < d[j].Name })
+  return d
+}
+
+//ComparatorRoute uses Comparator for the requests matched by
+//Match
+type ComparatorRoute struct {
+  Match RequestMatcher
+  Comparator Comparator
+}
+
+//RouteComparator picks the Comparator of the first route that
+//matches the request, or Default if none does.  A nil Default
+//uses a ResponseComparator
+type RouteComparator struct {
+  Routes []ComparatorRoute
+  Default Comparator
+}
+
+//Compare compares the responses with the Comparator of r's route
+func (c RouteComparator) Compare(r *http.Request, prod ResponseInfo, staging ResponseInfo) *DiffResult {
+  for _, route := range c.Routes {
+    if route.Match(r) {
+      return route.Comparator.Compare(r, prod, staging)
+    }
+  }
+  if c.Default == nil {
+    return ResponseComparator{}.Compare(r, prod, staging)
+  }
+  return c.Default.Compare(r, prod, staging)
+}
+
+//TextComparator compares bodies line by line, reporting each
+//line that differs with a Path of "line N", counting from 1.
+//At most MaxDiffs lines are reported, all of them if it is 0
+type TextComparator struct {
+  MaxDiffs int
+}
+
+//CompareBodies compares the bodies line by line
+func (c TextComparator) CompareBodies(prod ResponseInfo, staging ResponseInfo) []BodyDiff {
+  if prod.Body == staging.Body {
+    return nil
+  }
+  pl := strings.Split(prod.Body, "\n")
+  sl := strings.Split(staging.Body, "\n")
+  d := []BodyDiff{}
+  for i := 0; i < len(pl) || i < len(sl); i++ {
+    var p, s string
+    if i < len(pl) {
+      p = pl[i]
+    }
+    if i < len(sl) {
+      s = sl[i]
+    }
+    if p == s && i < len(pl) && i < len(sl) {
+      continue
+    }
+    d = append(d, BodyDiff{Path: fmt.Sprintf("line %d", i + 1), Prod: p, Staging: s})
+    if c.MaxDiffs > 0 && len(d) == c.MaxDiffs {
+      break
+    }
+  }
+  return d
+}
@@ -0,0 +1,110 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  )
+
+func TestResponseComparator(t *testing.T) {
+  base := ResponseInfo{Status: 200, Header: http.Header{"Content-Type": {"text/plain"},
+                       "Date": {"today"}}, Body: "a\nb"}
+  tests := []struct {
+    Name string
+    Comparator ResponseComparator
+    Staging ResponseInfo
+    Match bool
+    Status bool
+    Headers string
+    Body string
+  } {
+    {"same", ResponseComparator{}, ResponseInfo{200, http.Header{"Content-Type": {"text/plain"},
+      "Date": {"tomorrow"}}, "a\nb"}, true, false, "[]", "[]"},
+    {"status", ResponseComparator{}, ResponseInfo{500, http.Header{"Content-Type": {"text/plain"}},
+      "a\nb"}, false, true, "[]", "[]"},
+    {"header", ResponseComparator{}, ResponseInfo{200, http.Header{"Content-Type": {"text/html"},
+      "X-New": {"1"}}, "a\nb"}, false, false,
+      "[{Content-Type [text/plain] [text/html]} {X-New [] [1]}]", "[]"},
+    {"ignored header", ResponseComparator{IgnoreHeaders: []string{"content-type", "date"}},
+      ResponseInfo{200, http.Header{"Content-Type": {"text/html"}}, "a\nb"}, true, false, "[]", "[]"},
+    {"all headers", ResponseComparator{IgnoreHeaders: []string{}},
+      ResponseInfo{200, http.Header{"Content-Type": {"text/plain"}}, "a\nb"}, false, false,
+      "[{Date [today] []}]", "[]"},
+    {"body", ResponseComparator{}, ResponseInfo{200, http.Header{"Content-Type": {"text/plain"}},
+      "a\nc\nd"}, false, false, "[]", "[{line 2 b c} {line 3  d}]"},
+  }
+  for _, test := range tests {
+    d := test.Comparator.Compare(newTestRequest(), base, test.Staging)
+    if d.Match != test.Match || d.StatusMismatch != test.Status {
+      t.Errorf("%s: Expected: match %t status %t Got: %+v", test.Name, test.Match, test.Status, d)
+    }
+    if h := fmt.Sprint(d.Headers); h != test.Headers {
+      t.Errorf("%s: Headers Expected: %s Got: %s", test.Name, test.Headers, h)
+    }
+    if b := fmt.Sprint(d.Body); b != test.Body && !(test.Body == "[]" && len(d.Body) == 0) {
+      t.Errorf("%s: Body Expected: %s Got: %s", test.Name, test.Body, b)
+    }
+  }
+}
+
+func TestTextComparatorMaxDiffs(t *testing.T) {
+  d := TextComparator{MaxDiffs: 2}.CompareBodies(ResponseInfo{Body: "1\n2\n3"}, ResponseInfo{Body: "4\n5\n6"})
+  if len(d) != 2 {
+    t.Errorf("Expected: 2 diffs Got: %v", d)
+  }
+}
+
+func TestHandleStagingAttachesDiff(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+  ss := newStagingServer()
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  k := NewKyogetsuProxyWithOptions(NewSingleProxyHandler(ps.URL, ss.URL), ms, getMemoryCache(),
+                                   CookieIdFunction("id"), Options{Comparator: ResponseComparator{}})
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+
+  m := waitMessage(t, ms)
+  if m.Diff == nil {
+    t.Fatal("The Message has no DiffResult")
+  }
+  if m.Diff.Match || len(m.Diff.Body) != 1 || m.Diff.Body[0].Prod != "Prod" {
+    t.Errorf("Expected a body difference Got: %+v", m.Diff)
+  }
+}
+
+func TestHandleStagingComparesTruncatedBody(t *testing.T) {
+  body := strings.Repeat("x", 100)
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprint(w, body)
+  }))
+  defer s.Close()
+
+  ms := make(chanSender, 1)
+  k := NewKyogetsuProxyWithOptions(NewSingleProxyHandler(s.URL, s.URL), ms, getMemoryCache(),
+                                   CookieIdFunction("id"),
+                                   Options{Comparator: ResponseComparator{}, MaxResponseCapture: 10})
+  r, _ := http.NewRequest("GET", s.URL + "/", nil)
+  w := httptest.NewRecorder()
+  k.ServeHTTP(w, r)
+  if w.Body.String() != body {
+    t.Errorf("The client did not get the full body Got: %s", w.Body.String())
+  }
+
+  m := waitMessage(t, ms)
+  if !m.ProdTruncated {
+    t.Error("The Message does not say the production body was truncated")
+  }
+  if m.Diff == nil || !m.Diff.Match {
+    t.Errorf("Expected identical responses to match Got: %+v", m.Diff)
+  }
+}
@@ -0,0 +1,186 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "context"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+//OverflowPolicy decides what a StagingDispatcher does with a
+//new mirror when its queue is full
+type OverflowPolicy int
+
+const (
+  //DropNewest discards the mirror that could not be queued
+  DropNewest OverflowPolicy = iota
+  //DropOldest discards the oldest queued mirror to make room
+  //for the new one
+  DropOldest
+  //Block waits up to the block timeout for room in the queue
+  //and discards the new mirror if none becomes available
+  Block
+)
+
+//DispatcherStats holds the counters of a StagingDispatcher
+type DispatcherStats struct {
+  //Accepted is the number of mirrors that were queued
+  Accepted uint64
+  //Dropped is the number of mirrors discarded by the
+  //overflow policy
+  Dropped uint64
+  //Completed is the number of mirrors that have run
+  Completed uint64
+  //Pending is the number of mirrors waiting in the queue
+  Pending int
+}
+
+//stagingJob is a unit of staging work.  drop is called
+//instead of run if the job is discarded
+type stagingJob struct {
+  run func()
+  drop func()
+}
+
+//A StagingDispatcher runs staging work on a fixed number of
+//workers fed by a bounded queue, so a slow staging server can
+//never pile up goroutines and memory in the proxy
+type StagingDispatcher struct {
+  queue chan stagingJob
+  policy OverflowPolicy
+  timeout time.Duration
+  accepted uint64
+  dropped uint64
+  completed uint64
+  mu sync.RWMutex
+  closed bool
+  wg sync.WaitGroup
+}
+
+//NewStagingDispatcher creates a StagingDispatcher and starts
+//its workers.  timeout is only used by the Block policy
+func NewStagingDispatcher(workers int, size int, policy OverflowPolicy, timeout time.Duration) *StagingDispatcher {
+  d := &StagingDispatcher{
+    queue: make(chan stagingJob, size),
+    policy: policy,
+    timeout: timeout,
+  }
+  d.wg.Add(workers)
+  for i := 0; i < workers; i++ {
+    go d.work()
+  }
+  return d
+}
+
+//Submit queues run to be called by a worker, applying the
+//overflow policy if the queue is full.  drop, if not nil, is
+//called for any job that is discarded.  Submit reports
+//whether run was queued.  Once the dispatcher is closed every
+//job is dropped
+func (d *StagingDispatcher) Submit(run func(), drop func()) bool {
+  j := stagingJob{run: run, drop: drop}
+  d.mu.RLock()
+  defer d.mu.RUnlock()
+  if d.closed {
+    d.discard(j)
+    return false
+  }
+  select {
+  case d.queue <- j:
+    atomic.AddUint64(&d.accepted, 1)
+    return true
+  default:
+  }
+
+  switch d.policy {
+  case DropOldest:
+    for {
+      select {
+      case d.queue <- j:
+        atomic.AddUint64(&d.accepted, 1)
+        return true
+      default:
+      }
+      select {
+      case old := <-d.queue:
+        d.discard(old)
+      default:
+      }
+    }
+  case Block:
+    t := time.NewTimer(d.timeout)
+    defer t.Stop()
+    select {
+    case d.queue <- j:
+      atomic.AddUint64(&d.accepted, 1)
+      return true
+    case <-t.C:
+    }
+  }
+  d.discard(j)
+  return false
+}
+
+//Stats returns a snapshot of the dispatcher's counters
+func (d *StagingDispatcher) Stats() DispatcherStats {
+  return DispatcherStats{
+    Accepted: atomic.LoadUint64(&d.accepted),
+    Dropped: atomic.LoadUint64(&d.dropped),
+    Completed: atomic.LoadUint64(&d.completed),
+    Pending: len(d.queue),
+  }
+}
+
+//Close stops the dispatcher from accepting new jobs.  Jobs
+//already queued are still run
+func (d *StagingDispatcher) Close() {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  if !d.closed {
+    d.closed = true
+    close(d.queue)
+  }
+}
+
+//Closed reports whether Close has been called
+func (d *StagingDispatcher) Closed() bool {
+  d.mu.RLock()
+  defer d.mu.RUnlock()
+  return d.closed
+}
+
+//Wait blocks until every queued job has run after Close, or
+//until ctx is done in which case ctx's error is returned
+func (d *StagingDispatcher) Wait(ctx context.Context) error {
+  done := make(chan struct{})
+  go func() {
+    d.wg.Wait()
+    close(done)
+  }()
+  select {
+  case <-done:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+func (d *StagingDispatcher) work() {
+  defer d.wg.Done()
+  for j := range d.queue {
+    j.run()
+    atomic.AddUint64(&d.completed, 1)
+  }
+}
+
+func (d *StagingDispatcher) discard(j stagingJob) {
+  atomic.AddUint64(&d.dropped, 1)
+  if j.drop != nil {
+    j.drop()
+  }
+}
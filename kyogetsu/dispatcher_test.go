@@ -0,0 +1,118 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "context"
+  "sync"
+  "testing"
+  "time"
+  )
+
+//blockDispatcher fills a single worker dispatcher with a job that
+//waits on the returned channel
+func blockDispatcher(policy OverflowPolicy, size int) (*StagingDispatcher, chan struct{}) {
+  d := NewStagingDispatcher(1, size, policy, 20 * time.Millisecond)
+  release := make(chan struct{})
+  started := make(chan struct{})
+  d.Submit(func() {
+    close(started)
+    <-release
+  }, nil)
+  <-started
+  return d, release
+}
+
+func TestStagingDispatcherRunsJobs(t *testing.T) {
+  d := NewStagingDispatcher(4, 10, DropNewest, 0)
+  var wg sync.WaitGroup
+  wg.Add(20)
+  for i := 0; i < 20; i++ {
+    for !d.Submit(wg.Done, nil) {
+      time.Sleep(time.Millisecond)
+    }
+  }
+  wg.Wait()
+  time.Sleep(10 * time.Millisecond)
+  s := d.Stats()
+  if s.Completed != 20 {
+    t.Errorf("Expected: 20 completed Got: %d", s.Completed)
+  }
+}
+
+func TestStagingDispatcherOverflow(t *testing.T) {
+  tests := []struct {
+    Policy OverflowPolicy
+    Queued bool
+    DroppedId int
+  } {
+    {DropNewest, false, 2},
+    {DropOldest, true, 1},
+    {Block, false, 2},
+  }
+  for _, test := range tests {
+    d, release := blockDispatcher(test.Policy, 1)
+    dropped := make(chan int, 2)
+    ran := make(chan int, 2)
+    for i := 1; i <= 2; i++ {
+      id := i
+      ok := d.Submit(func() { ran <- id }, func() { dropped <- id })
+      if id == 2 && ok != test.Queued {
+        t.Errorf("Policy %d: Queued Expected: %t Got: %t", test.Policy, test.Queued, ok)
+      }
+    }
+    if id := <-dropped; id != test.DroppedId {
+      t.Errorf("Policy %d: Dropped Expected: %d Got: %d", test.Policy, test.DroppedId, id)
+    }
+    if s := d.Stats(); s.Dropped != 1 {
+      t.Errorf("Policy %d: Dropped count Expected: 1 Got: %d", test.Policy, s.Dropped)
+    }
+    close(release)
+    if id := <-ran; id == test.DroppedId {
+      t.Errorf("Policy %d: Dropped job %d was run", test.Policy, id)
+    }
+  }
+}
+
+func TestStagingDispatcherBlockWaits(t *testing.T) {
+  d, release := blockDispatcher(Block, 1)
+  d.timeout = time.Second
+  d.Submit(func() {}, nil)
+  go func() {
+    time.Sleep(10 * time.Millisecond)
+    close(release)
+  }()
+  if !d.Submit(func() {}, nil) {
+    t.Error("Block should have waited for room in the queue")
+  }
+}
+
+func TestStagingDispatcherCloseDrainsQueue(t *testing.T) {
+  d, release := blockDispatcher(DropNewest, 2)
+  ran := make(chan struct{}, 2)
+  d.Submit(func() { ran <- struct{}{} }, nil)
+  d.Close()
+  d.Close()
+
+  dropped := false
+  if d.Submit(func() {}, func() { dropped = true }) || !dropped {
+    t.Error("A closed dispatcher should drop new jobs")
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+  defer cancel()
+  if err := d.Wait(ctx); err != context.DeadlineExceeded {
+    t.Errorf("Expected: %s Got: %v", context.DeadlineExceeded, err)
+  }
+
+  close(release)
+  if err := d.Wait(context.Background()); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if len(ran) != 1 {
+    t.Error("The queued job was not run before Wait returned")
+  }
+}
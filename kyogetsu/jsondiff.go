@@ -0,0 +1,391 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "math/big"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+//JSONComparator compares JSON bodies structurally, so key order
+//and formatting do not matter, and reports each difference with
+//its JSONPath, such as $.items[2].price.  A value missing from
+//one side is reported as an empty string on that side, other
+//values are shown as JSON.  Rules select values with JSONPath
+//globs: $ is the root, .name or ['name'] a member, [n] an array
+//element, * or [*] any member or element, and .. any number of
+//levels, so $..id is every id.  Bodies that are not JSON are
+//compared with TextComparator
+type JSONComparator struct {
+  //Ignore lists the values that are never compared
+  Ignore []string
+  //Unordered lists the arrays whose order does not matter
+  Unordered []string
+  //TypeOnly lists the values that only have to be of the same
+  //JSON type, for volatile fields such as timestamps
+  TypeOnly []string
+  //Tolerance is the largest difference allowed between two
+  //numbers
+  Tolerance float64
+  //Tolerances overrides Tolerance for the numbers they match,
+  //the first match is used
+  Tolerances []JSONTolerance
+  //MaxDiffs limits the differences reported, all of them are
+  //reported if it is 0
+  MaxDiffs int
+}
+
+//JSONTolerance allows numbers matching Path to differ by Delta
+type JSONTolerance struct {
+  Path string
+  Delta float64
+}
+
+//jsonSeg is one step of a JSONPath.  In a pattern any matches
+//every member or element and deep matches any number of steps
+type jsonSeg struct {
+  key string
+  index int
+  isIndex bool
+  any bool
+  deep bool
+}
+
+//jsonRules holds the parsed rules of a JSONComparator
+type jsonRules struct {
+  c JSONComparator
+  ignore [][]jsonSeg
+  unordered [][]jsonSeg
+  typeOnly [][]jsonSeg
+  tolerances [][]jsonSeg
+}
+
+//CompareBodies compares the bodies as JSON
+func (c JSONComparator) CompareBodies(prod ResponseInfo, staging ResponseInfo) []BodyDiff {
+  p, perr := decodeJSON(prod.Body)
+  s, serr := decodeJSON(staging.Body)
+  if perr != nil || serr != nil {
+    return TextComparator{MaxDiffs: c.MaxDiffs}.CompareBodies(prod, staging)
+  }
+  r := jsonRules{
+    c: c,
+    ignore: parseJSONPaths(c.Ignore),
+    unordered: parseJSONPaths(c.Unordered),
+    typeOnly: parseJSONPaths(c.TypeOnly),
+  }
+  for _, t := range c.Tolerances {
+    seg, _ := parseJSONPath(t.Path)
+    r.tolerances = append(r.tolerances, seg)
+  }
+  d := []BodyDiff{}
+  r.compare(nil, p, true, s, true, &d)
+  if c.MaxDiffs > 0 && len(d) > c.MaxDiffs {
+    d = d[:c.MaxDiffs]
+  }
+  return d
+}
+
+func decodeJSON(s string) (interface{}, error) {
+  d := json.NewDecoder(strings.NewReader(s))
+  d.UseNumber()
+  var v interface{}
+  if err := d.Decode(&v); err != nil {
+    return nil, err
+  }
+  if d.More() {
+    return nil, errors.New("trailing data after JSON value")
+  }
+  return v, nil
+}
+
+//compare compares the values at path, pok and sok tell whether
+//each side has a value there
+func (r jsonRules) compare(path []jsonSeg, p interface{}, pok bool, s interface{}, sok bool, d *[]BodyDiff) {
+  if matchAnyJSONPath(r.ignore, path) {
+    return
+  }
+  if !pok || !sok || jsonType(p) != jsonType(s) {
+    r.diff(path, p, pok, s, sok, d)
+    return
+  }
+  if matchAnyJSONPath(r.typeOnly, path) {
+    return
+  }
+
+  switch pv := p.(type) {
+  case map[string]interface{}:
+    sv := s.(map[string]interface{})
+    keys := make([]string, 0, len(pv) + len(sv))
+    for k := range pv {
+      keys = append(keys, k)
+    }
+    for k := range sv {
+      if _, ok := pv[k]; !ok {
+        keys = append(keys, k)
+      }
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+      a, aok := pv[k]
+      b, bok := sv[k]
+      r.compare(childPath(path, jsonSeg{key: k}), a, aok, b, bok, d)
+    }
+  case []interface{}:
+    sv := s.([]interface{})
+    if matchAnyJSONPath(r.unordered, path) {
+      r.compareUnordered(path, pv, sv, d)
+      return
+    }
+    for i := 0; i < len(pv) || i < len(sv); i++ {
+      var a, b interface{}
+      if i < len(pv) {
+        a = pv[i]
+      }
+      if i < len(sv) {
+        b = sv[i]
+      }
+      r.compare(childPath(path, jsonSeg{index: i, isIndex: true}), a, i < len(pv), b, i < len(sv), d)
+    }
+  case json.Number:
+    if !r.numbersEqual(path, pv, s.(json.Number)) {
+      r.diff(path, p, true, s, true, d)
+    }
+  default:
+    if p != s {
+      r.diff(path, p, true, s, true, d)
+    }
+  }
+}
+
+//compareUnordered pairs every production element with an equal
+//staging element, reporting the ones left on either side
+func (r jsonRules) compareUnordered(path []jsonSeg, p []interface{}, s []interface{}, d *[]BodyDiff) {
+  used := make([]bool, len(s))
+  for i, a := range p {
+    child := childPath(path, jsonSeg{index: i, isIndex: true})
+    found := false
+    for j, b := range s {
+      if used[j] {
+        continue
+      }
+      tmp := []BodyDiff{}
+      r.compare(child, a, true, b, true, &tmp)
+      if len(tmp) == 0 {
+        used[j] = true
+        found = true
+        break
+      }
+    }
+    if !found {
+      r.diff(child, a, true, nil, false, d)
+    }
+  }
+  for j, b := range s {
+    if !used[j] {
+      r.diff(childPath(path, jsonSeg{index: j, isIndex: true}), nil, false, b, true, d)
+    }
+  }
+}
+
+//numbersEqual compares the numbers exactly, so large integer
+//ids do not lose their last digits, allowing the tolerance of
+//the path
+func (r jsonRules) numbersEqual(path []jsonSeg, p json.Number, s json.Number) bool {
+  a, aok := new(big.Rat).SetString(p.String())
+  b, bok := new(big.Rat).SetString(s.String())
+  if !aok || !bok {
+    return p == s
+  }
+  tol := r.c.Tolerance
+  for i, t := range r.tolerances {
+    if t != nil && matchJSONPath(t, path) {
+      tol = r.c.Tolerances[i].Delta
+      break
+    }
+  }
+  if tol <= 0 {
+    return a.Cmp(b) == 0
+  }
+  d := new(big.Rat).Sub(a, b)
+  t := new(big.Rat)
+  if t.SetFloat64(tol) == nil {
+    //an infinite tolerance accepts every number
+    return true
+  }
+  return d.Abs(d).Cmp(t) <= 0
+}
+
+func (r jsonRules) diff(path []jsonSeg, p interface{}, pok bool, s interface{}, sok bool, d *[]BodyDiff) {
+  bd := BodyDiff{Path: formatJSONPath(path)}
+  if pok {
+    bd.Prod = jsonString(p)
+  }
+  if sok {
+    bd.Staging = jsonString(s)
+  }
+  *d = append(*d, bd)
+}
+
+func jsonString(v interface{}) string {
+  var b bytes.Buffer
+  e := json.NewEncoder(&b)
+  e.SetEscapeHTML(false)
+  e.Encode(v)
+  return strings.TrimSuffix(b.String(), "\n")
+}
+
+//jsonType names the JSON type of a decoded value
+func jsonType(v interface{}) string {
+  switch v.(type) {
+  case map[string]interface{}:
+    return "object"
+  case []interface{}:
+    return "array"
+  case string:
+    return "string"
+  case json.Number:
+    return "number"
+  case bool:
+    return "boolean"
+  }
+  return "null"
+}
+
+//childPath returns a new path of path followed by s
+func childPath(path []jsonSeg, s jsonSeg) []jsonSeg {
+  c := make([]jsonSeg, len(path) + 1)
+  copy(c, path)
+  c[len(path)] = s
+  return c
+}
+
+var jsonIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+//formatJSONPath writes path as a JSONPath
+func formatJSONPath(path []jsonSeg) string {
+  var b strings.Builder
+  b.WriteString("$")
+  for _, s := range path {
+    switch {
+    case s.isIndex:
+      b.WriteString("[" + strconv.Itoa(s.index) + "]")
+    case jsonIdentifier.MatchString(s.key):
+      b.WriteString("." + s.key)
+    default:
+      b.WriteString("['" + strings.Replace(s.key, "'", `\'`, -1) + "']")
+    }
+  }
+  return b.String()
+}
+
+//parseJSONPaths parses the patterns, leaving out any that are
+//not valid
+func parseJSONPaths(p []string) [][]jsonSeg {
+  s := make([][]jsonSeg, 0, len(p))
+  for _, v := range p {
+    if seg, err := parseJSONPath(v); err == nil {
+      s = append(s, seg)
+    }
+  }
+  return s
+}
+
+//parseJSONPath parses a JSONPath glob such as $.items[*].id
+func parseJSONPath(p string) ([]jsonSeg, error) {
+  if !strings.HasPrefix(p, "$") {
+    return nil, errors.New("JSONPath must start with $")
+  }
+  seg := []jsonSeg{}
+  for i := 1; i < len(p); {
+    switch {
+    case strings.HasPrefix(p[i:], ".."):
+      seg = append(seg, jsonSeg{deep: true})
+      //$..name keeps the second dot for the name, $..[0] does not
+      i += 1
+      if i + 1 < len(p) && p[i + 1] == '[' {
+        i += 1
+      }
+    case p[i] == '.':
+      j := i + 1
+      for j < len(p) && p[j] != '.' && p[j] != '[' {
+        j++
+      }
+      name := p[i + 1:j]
+      switch name {
+      case "":
+        return nil, errors.New("empty name in JSONPath " + p)
+      case "*":
+        seg = append(seg, jsonSeg{any: true})
+      default:
+        seg = append(seg, jsonSeg{key: name})
+      }
+      i = j
+    case p[i] == '[':
+      j := strings.Index(p[i:], "]")
+      if j < 0 {
+        return nil, errors.New("unclosed [ in JSONPath " + p)
+      }
+      in := p[i + 1:i + j]
+      switch {
+      case in == "*":
+        seg = append(seg, jsonSeg{any: true})
+      case len(in) >= 2 && in[0] == '\'' && in[len(in) - 1] == '\'':
+        seg = append(seg, jsonSeg{key: strings.Replace(in[1:len(in) - 1], `\'`, "'", -1)})
+      default:
+        n, err := strconv.Atoi(in)
+        if err != nil || n < 0 {
+          return nil, errors.New("invalid index in JSONPath " + p)
+        }
+        seg = append(seg, jsonSeg{index: n, isIndex: true})
+      }
+      i += j + 1
+    default:
+      return nil, errors.New("unexpected character in JSONPath " + p)
+    }
+  }
+  if len(seg) > 0 && seg[len(seg) - 1].deep {
+    return nil, errors.New("JSONPath can not end with .. " + p)
+  }
+  return seg, nil
+}
+
+func matchAnyJSONPath(patterns [][]jsonSeg, path []jsonSeg) bool {
+  for _, p := range patterns {
+    if matchJSONPath(p, path) {
+      return true
+    }
+  }
+  return false
+}
+
+//matchJSONPath reports whether path matches the pattern
+func matchJSONPath(pattern []jsonSeg, path []jsonSeg) bool {
+  if len(pattern) == 0 {
+    return len(path) == 0
+  }
+  if pattern[0].deep {
+    for i := 0; i <= len(path); i++ {
+      if matchJSONPath(pattern[1:], path[i:]) {
+        return true
+      }
+    }
+    return false
+  }
+  if len(path) == 0 {
+    return false
+  }
+  p, s := pattern[0], path[0]
+  if !p.any && (p.isIndex != s.isIndex || p.key != s.key || p.index != s.index) {
+    return false
+  }
+  return matchJSONPath(pattern[1:], path[1:])
+}
@@ -0,0 +1,116 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "testing"
+  )
+
+func TestJSONComparator(t *testing.T) {
+  tests := []struct {
+    Name string
+    Comparator JSONComparator
+    Prod string
+    Staging string
+    Diffs string
+  } {
+    {"same", JSONComparator{}, `{"a": 1, "b": [1, 2]}`, `{"b":[1,2],"a":1.0}`, "[]"},
+    {"value", JSONComparator{}, `{"a": {"b": [1, "x"]}}`, `{"a": {"b": [1, "y"]}}`,
+      `[{$.a.b[1] "x" "y"}]`},
+    {"missing", JSONComparator{}, `{"a": 1, "odd key": true}`, `{"a": 1, "c": null}`,
+      `[{$.c  null} {$['odd key'] true }]`},
+    {"array length", JSONComparator{}, `[1, 2, 3]`, `[1]`, "[{$[1] 2 } {$[2] 3 }]"},
+    {"type", JSONComparator{}, `{"a": "1"}`, `{"a": 1}`, `[{$.a "1" 1}]`},
+    {"ignore", JSONComparator{Ignore: []string{"$.meta", "$.items[*].id"}},
+      `{"meta": {"t": 1}, "items": [{"id": 1, "n": "a"}]}`,
+      `{"meta": {"t": 2}, "items": [{"id": 9, "n": "a"}]}`, "[]"},
+    {"ignore deep", JSONComparator{Ignore: []string{"$..request_id"}},
+      `{"request_id": 1, "a": [{"request_id": 2}]}`, `{"request_id": 3, "a": [{"request_id": 4}]}`, "[]"},
+    {"ordered", JSONComparator{}, `{"tags": ["a", "b"]}`, `{"tags": ["b", "a"]}`,
+      `[{$.tags[0] "a" "b"} {$.tags[1] "b" "a"}]`},
+    {"unordered", JSONComparator{Unordered: []string{"$.tags"}}, `{"tags": ["a", "b", "b"]}`,
+      `{"tags": ["b", "a", "b"]}`, "[]"},
+    {"unordered extra", JSONComparator{Unordered: []string{"$.tags"}}, `{"tags": ["a", "b"]}`,
+      `{"tags": ["c", "a"]}`, `[{$.tags[1] "b" } {$.tags[0]  "c"}]`},
+    {"unordered ignore", JSONComparator{Unordered: []string{"$.items"}, Ignore: []string{"$.items[*].id"}},
+      `{"items": [{"id": 1, "n": "a"}, {"id": 2, "n": "b"}]}`,
+      `{"items": [{"id": 3, "n": "b"}, {"id": 4, "n": "a"}]}`, "[]"},
+    {"tolerance", JSONComparator{Tolerance: 0.01}, `{"a": 1.001, "b": 2}`, `{"a": 1.005, "b": 2.1}`,
+      "[{$.b 2 2.1}]"},
+    {"path tolerance", JSONComparator{Tolerances: []JSONTolerance{{"$.b", 0.5}}},
+      `{"a": 1.001, "b": 2}`, `{"a": 1.005, "b": 2.1}`, "[{$.a 1.001 1.005}]"},
+    {"type only", JSONComparator{TypeOnly: []string{"$.time", "$.id"}},
+      `{"time": "2017-01-01", "id": 1}`, `{"time": "2018-01-01", "id": "x"}`, `[{$.id 1 "x"}]`},
+    {"big integers", JSONComparator{}, `{"id": 9007199254740993}`, `{"id": 9007199254740992}`,
+      "[{$.id 9007199254740993 9007199254740992}]"},
+    {"exponent", JSONComparator{}, `[100, 0.5]`, `[1e2, 5E-1]`, "[]"},
+    {"max diffs", JSONComparator{MaxDiffs: 1}, `[1, 2]`, `[3, 4]`, "[{$[0] 1 3}]"},
+    {"not json", JSONComparator{}, `{"a": 1}`, "<html>", `[{line 1 {"a": 1} <html>}]`},
+  }
+  for _, test := range tests {
+    d := test.Comparator.CompareBodies(ResponseInfo{Body: test.Prod}, ResponseInfo{Body: test.Staging})
+    if s := fmt.Sprint(d); s != test.Diffs {
+      t.Errorf("%s: Expected: %s Got: %s", test.Name, test.Diffs, s)
+    }
+  }
+}
+
+func TestParseJSONPath(t *testing.T) {
+  tests := []struct {
+    Pattern string
+    Path string
+    Match bool
+  } {
+    {"$", "$", true},
+    {"$.a.b", "$.a.b", true},
+    {"$.a", "$.a.b", false},
+    {"$.*.b", "$.x.b", true},
+    {"$.a[*]", "$.a[3]", true},
+    {"$.a[2]", "$.a[3]", false},
+    {"$..id", "$.a[0].b.id", true},
+    {"$..id", "$.id", true},
+    {"$..[*]", "$.a[0]", true},
+    {"$..[1]", "$.a.b", false},
+    {"$..b.id", "$.a.id", false},
+    {"$['odd key']", "$['odd key']", true},
+    {"a.b", "$.a.b", false},
+    {"$.a[", "$.a", false},
+    {"$..", "$.a", false},
+  }
+  for _, test := range tests {
+    pattern, err := parseJSONPath(test.Pattern)
+    path, _ := parseJSONPath(test.Path)
+    if m := err == nil && matchJSONPath(pattern, path); m != test.Match {
+      t.Errorf("%s %s: Expected: %t Got: %t", test.Pattern, test.Path, test.Match, m)
+    }
+    if f := formatJSONPath(path); f != test.Path {
+      t.Errorf("%s: Format Got: %s", test.Path, f)
+    }
+  }
+}
+
+func TestRouteComparator(t *testing.T) {
+  c := RouteComparator{Routes: []ComparatorRoute{
+    {MatchPathPrefix("/api"), ResponseComparator{Body: JSONComparator{Ignore: []string{"$.t"}}}},
+  }}
+  prod := ResponseInfo{Status: 200, Body: `{"t": 1}`}
+  staging := ResponseInfo{Status: 200, Body: `{"t": 2}`}
+  tests := []struct {
+    Path string
+    Match bool
+  } {
+    {"/api/users", true},
+    {"/static", false},
+  }
+  for _, test := range tests {
+    r, _ := http.NewRequest("GET", "http://example.com" + test.Path, nil)
+    if d := c.Compare(r, prod, staging); d.Match != test.Match {
+      t.Errorf("%s: Expected: %t Got: %+v", test.Path, test.Match, d)
+    }
+  }
+}
@@ -0,0 +1,370 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "container/list"
+  "errors"
+  "net/http"
+  "sync"
+  "time"
+)
+
+//ErrCookieNotFound is returned when a cookie or session is not
+//in the cache
+var ErrCookieNotFound = errors.New("cookie not found")
+
+//MemoryCacheStats holds the counters of a MemoryCache
+type MemoryCacheStats struct {
+  //Sessions is the number of sessions in the cache
+  Sessions int
+  //Hits and Misses count the lookups of existing and
+  //missing sessions
+  Hits uint64
+  Misses uint64
+  //Evictions is the number of sessions removed to stay under
+  //the maximum session count
+  Evictions uint64
+  //Expirations is the number of sessions removed by the TTL
+  Expirations uint64
+}
+
+//A CookieCache that keeps the cookies in memory, for single
+//instance setups and tests that should not need Redis.  It
+//holds at most a fixed number of sessions, evicting the
+//least recently used one to make room, and drops sessions
+//that have not been used for the TTL.  It is safe for
+//concurrent use
+type MemoryCache struct {
+  mu sync.Mutex
+  maxSessions int
+  ttl time.Duration
+  lru *list.List
+  sessions map[string]*list.Element
+  //staging maps staging session ids to the session they
+  //are linked to
+  staging map[string]string
+  stats MemoryCacheStats
+  conflict IdConflictPolicy
+  grace time.Duration
+  now func() time.Time
+}
+
+//memorySession is the cookie data of one session
+type memorySession struct {
+  id string
+  cookies map[string]*http.Cookie
+  expires time.Time
+  //deadline is when an old id's grace period ends, using the
+  //session does not extend it
+  deadline time.Time
+  //stagingId is the staging session id linked to the session
+  stagingId string
+}
+
+//NewMemoryCache creates a MemoryCache holding at most
+//maxSessions sessions, each expiring when it has not been
+//used for ttl.  A maxSessions or ttl of zero disables the
+//limit
+func NewMemoryCache(maxSessions int, ttl time.Duration) *MemoryCache {
+  return &MemoryCache{
+    maxSessions: maxSessions,
+    ttl: ttl,
+    lru: list.New(),
+    sessions: map[string]*list.Element{},
+    staging: map[string]string{},
+    grace: DefaultOldIdGrace,
+    now: time.Now,
+  }
+}
+
+//SetChangeIdPolicy sets how ChangeCookiesId merges the cookies
+//of the old id into those of the new id, and how long the old
+//id keeps working afterwards.  A grace of zero removes the old
+//id at once.  The default is OldIdWins with DefaultOldIdGrace
+func (m *MemoryCache) SetChangeIdPolicy(conflict IdConflictPolicy, grace time.Duration) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.conflict = conflict
+  m.grace = grace
+}
+
+//SetCookie stores a copy of c in the id's session
+func (m *MemoryCache) SetCookie(id string, c *http.Cookie) error {
+  return m.SetCookies(id, []*http.Cookie{c})
+}
+
+//SetCookies stores copies of the cookies in the id's session
+func (m *MemoryCache) SetCookies(id string, c []*http.Cookie) error {
+  if len(c) == 0 {
+    return nil
+  }
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  now := m.now()
+  s := m.session(id, now)
+  if s == nil {
+    s = m.insert(id, now)
+  }
+  for _, v := range c {
+    s.cookies[v.Name] = copyCookie(v, now)
+  }
+  return nil
+}
+
+//GetCookie gets a cookie stored in the id's session
+func (m *MemoryCache) GetCookie(id string, key string) (*http.Cookie, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  s := m.lookup(id)
+  if s == nil || s.cookies[key] == nil {
+    return nil, ErrCookieNotFound
+  }
+  c := *s.cookies[key]
+  return &c, nil
+}
+
+//GetCookies gets all cookies stored for a given Id
+func (m *MemoryCache) GetCookies(id string) ([]*http.Cookie, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  s := m.lookup(id)
+  if s == nil {
+    return []*http.Cookie{}, nil
+  }
+  c := make([]*http.Cookie, 0, len(s.cookies))
+  for _, v := range s.cookies {
+    cc := *v
+    c = append(c, &cc)
+  }
+  return c, nil
+}
+
+//DeleteCookie removes a cookie from the id's session
+func (m *MemoryCache) DeleteCookie(id string, key string) error {
+  return m.DeleteCookies(id, []string{key})
+}
+
+//DeleteCookies removes the named cookies from the id's session
+func (m *MemoryCache) DeleteCookies(id string, keys []string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if s := m.session(id, m.now()); s != nil {
+    for _, k := range keys {
+      delete(s.cookies, k)
+    }
+  }
+  return nil
+}
+
+//ChangeCookiesId merges the cookies of old_id into new_id,
+//following the IdConflictPolicy.  old_id is removed once its
+//grace period, set by SetChangeIdPolicy, is over.  Nothing
+//happens if old_id has no session.  The staging session link
+//moves with the cookies unless new_id already has one
+func (m *MemoryCache) ChangeCookiesId(old_id string, new_id string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  now := m.now()
+  s := m.session(old_id, now)
+  if s == nil || old_id == new_id {
+    return nil
+  }
+  e := m.sessions[old_id]
+  n := m.session(new_id, now)
+  if n == nil && m.grace <= 0 {
+    //new_id has nothing to merge with, the session is renamed
+    delete(m.sessions, old_id)
+    s.id = new_id
+    m.sessions[new_id] = e
+    if s.stagingId != "" {
+      m.staging[s.stagingId] = new_id
+    }
+    return nil
+  }
+  if n == nil {
+    n = m.insert(new_id, now)
+  }
+
+  if m.conflict == FailOnConflict {
+    for k := range s.cookies {
+      if _, ok := n.cookies[k]; ok {
+        return ErrIdConflict
+      }
+    }
+  }
+  for k, v := range s.cookies {
+    if _, ok := n.cookies[k]; ok && m.conflict == NewIdWins {
+      continue
+    }
+    n.cookies[k] = v
+  }
+  if n.stagingId == "" && s.stagingId != "" {
+    n.stagingId = s.stagingId
+    m.staging[s.stagingId] = new_id
+    s.stagingId = ""
+  }
+  if m.grace <= 0 {
+    m.remove(e)
+    return nil
+  }
+  //the old id is read only by requests already in flight
+  if deadline := now.Add(m.grace); s.deadline.IsZero() || deadline.Before(s.deadline) {
+    s.deadline = deadline
+  }
+  if s.expires.IsZero() || s.deadline.Before(s.expires) {
+    s.expires = s.deadline
+  }
+  return nil
+}
+
+//MapSessionIds links the session prodId to the staging session
+//stagingId.  The link lives as long as the session of prodId
+func (m *MemoryCache) MapSessionIds(prodId string, stagingId string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  now := m.now()
+  s := m.session(prodId, now)
+  if s == nil {
+    s = m.insert(prodId, now)
+  }
+  if s.stagingId == stagingId {
+    return nil
+  }
+  if s.stagingId != "" {
+    delete(m.staging, s.stagingId)
+  }
+  if old, ok := m.staging[stagingId]; ok {
+    if e, ok := m.sessions[old]; ok {
+      e.Value.(*memorySession).stagingId = ""
+    }
+  }
+  s.stagingId = stagingId
+  m.staging[stagingId] = prodId
+  return nil
+}
+
+//StagingSessionId returns the staging session id linked to
+//prodId
+func (m *MemoryCache) StagingSessionId(prodId string) (string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  s := m.session(prodId, m.now())
+  if s == nil || s.stagingId == "" {
+    return "", ErrNoId
+  }
+  return s.stagingId, nil
+}
+
+//ProdSessionId returns the session id linked to stagingId
+func (m *MemoryCache) ProdSessionId(stagingId string) (string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  id, ok := m.staging[stagingId]
+  if !ok || m.session(id, m.now()) == nil {
+    return "", ErrNoId
+  }
+  return id, nil
+}
+
+//Stats returns a snapshot of the cache's counters
+func (m *MemoryCache) Stats() MemoryCacheStats {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  s := m.stats
+  s.Sessions = len(m.sessions)
+  return s
+}
+
+//lookup finds the id's session and counts the hit or miss
+func (m *MemoryCache) lookup(id string) *memorySession {
+  s := m.session(id, m.now())
+  if s == nil {
+    m.stats.Misses++
+  } else {
+    m.stats.Hits++
+  }
+  return s
+}
+
+//session returns the id's session, marking it as the most
+//recently used and extending its TTL.  Expired sessions are
+//removed and nil is returned
+func (m *MemoryCache) session(id string, now time.Time) *memorySession {
+  e, ok := m.sessions[id]
+  if !ok {
+    return nil
+  }
+  s := e.Value.(*memorySession)
+  if !s.expires.IsZero() && !now.Before(s.expires) {
+    m.remove(e)
+    m.stats.Expirations++
+    return nil
+  }
+  if m.ttl > 0 {
+    s.expires = now.Add(m.ttl)
+  }
+  if !s.deadline.IsZero() && (s.expires.IsZero() || s.deadline.Before(s.expires)) {
+    s.expires = s.deadline
+  }
+  m.lru.MoveToFront(e)
+  return s
+}
+
+//insert adds an empty session for id, evicting the least
+//recently used sessions if the cache is full.  Every session
+//gets the same TTL when it is used, so the expired ones are
+//at the back of the LRU and are removed first.  Old ids in
+//their grace period may expire sooner, they are removed when
+//they are used or reach the back
+func (m *MemoryCache) insert(id string, now time.Time) *memorySession {
+  for e := m.lru.Back(); e != nil; e = m.lru.Back() {
+    s := e.Value.(*memorySession)
+    if s.expires.IsZero() || now.Before(s.expires) {
+      break
+    }
+    m.remove(e)
+    m.stats.Expirations++
+  }
+  for m.maxSessions > 0 && len(m.sessions) >= m.maxSessions {
+    e := m.lru.Back()
+    s := e.Value.(*memorySession)
+    m.remove(e)
+    if !s.expires.IsZero() && !now.Before(s.expires) {
+      m.stats.Expirations++
+    } else {
+      m.stats.Evictions++
+    }
+  }
+  s := &memorySession{id: id, cookies: map[string]*http.Cookie{}}
+  if m.ttl > 0 {
+    s.expires = now.Add(m.ttl)
+  }
+  m.sessions[id] = m.lru.PushFront(s)
+  return s
+}
+
+func (m *MemoryCache) remove(e *list.Element) {
+  s := e.Value.(*memorySession)
+  m.lru.Remove(e)
+  delete(m.sessions, s.id)
+  if s.stagingId != "" && m.staging[s.stagingId] == s.id {
+    delete(m.staging, s.stagingId)
+  }
+}
+
+//copyCookie returns a copy of c with MaxAge turned into
+//Expires, the same way the other caches store it
+func copyCookie(c *http.Cookie, now time.Time) *http.Cookie {
+  cc := *c
+  if cc.MaxAge > 0 {
+    cc.Expires = now.Add(time.Duration(cc.MaxAge) * time.Second)
+  }
+  cc.MaxAge = 0
+  cc.Raw = ""
+  cc.Unparsed = nil
+  return &cc
+}
@@ -0,0 +1,232 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "sync"
+  "testing"
+  "time"
+  )
+
+//A clock that only moves when told to
+type testClock struct {
+  t time.Time
+}
+
+func (c *testClock) Now() time.Time {
+  return c.t
+}
+
+func newClockedMemoryCache(max int, ttl time.Duration) (*MemoryCache, *testClock) {
+  c := &testClock{time.Unix(1500000000, 0)}
+  m := NewMemoryCache(max, ttl)
+  m.now = c.Now
+  return m, c
+}
+
+func TestMemoryCacheSetGet(t *testing.T) {
+  m := NewMemoryCache(0, 0)
+  m.SetCookie("bill", &http.Cookie{Name: "type", Value: "test", Path: "/app"})
+  m.SetCookies("bill", []*http.Cookie{
+    &http.Cookie{Name: "name", Value: "bill"},
+    &http.Cookie{Name: "type", Value: "replaced"},
+  })
+
+  c, err := m.GetCookie("bill", "type")
+  if err != nil || c.Value != "replaced" {
+    t.Errorf("Expected: replaced Got: %v %v", c, err)
+  }
+  c.Value = "changed by caller"
+  if c, _ = m.GetCookie("bill", "type"); c.Value != "replaced" {
+    t.Error("Changing a returned cookie changed the cache")
+  }
+  if _, err = m.GetCookie("bill", "missing"); err != ErrCookieNotFound {
+    t.Errorf("Expected: %s Got: %v", ErrCookieNotFound, err)
+  }
+  all, _ := m.GetCookies("bill")
+  if len(all) != 2 {
+    t.Errorf("Expected: 2 cookies Got: %v", all)
+  }
+  none, err := m.GetCookies("nobody")
+  if err != nil || len(none) != 0 {
+    t.Errorf("Expected no cookies for a missing session Got: %v %v", none, err)
+  }
+}
+
+func TestMemoryCacheDeleteAndChangeId(t *testing.T) {
+  m := NewMemoryCache(0, 0)
+  m.SetChangeIdPolicy(OldIdWins, 0)
+  m.SetCookies("bill", []*http.Cookie{
+    &http.Cookie{Name: "a", Value: "1"},
+    &http.Cookie{Name: "b", Value: "2"},
+  })
+  m.SetCookie("bob", &http.Cookie{Name: "old", Value: "data"})
+  m.DeleteCookie("bill", "a")
+
+  if err := m.ChangeCookiesId("bill", "bob"); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  c, _ := m.GetCookies("bob")
+  if len(c) != 2 {
+    t.Errorf("Expected: [b=2 old=data] Got: %v", c)
+  }
+  if c, _ = m.GetCookies("bill"); len(c) != 0 {
+    t.Errorf("The old id still has cookies: %v", c)
+  }
+  if err := m.ChangeCookiesId("missing", "other"); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if s := m.Stats(); s.Sessions != 1 {
+    t.Errorf("Expected: 1 session Got: %d", s.Sessions)
+  }
+}
+
+func TestMemoryCacheChangeIdMerge(t *testing.T) {
+  tests := []struct {
+    Policy IdConflictPolicy
+    Err error
+    Shared string
+  } {
+    {OldIdWins, nil, "old"},
+    {NewIdWins, nil, "new"},
+    {FailOnConflict, ErrIdConflict, "new"},
+  }
+  for _, test := range tests {
+    m := NewMemoryCache(0, 0)
+    m.SetChangeIdPolicy(test.Policy, 0)
+    m.SetCookies("bill", []*http.Cookie{
+      &http.Cookie{Name: "shared", Value: "old"},
+      &http.Cookie{Name: "oldonly", Value: "1"},
+    })
+    m.SetCookies("bob", []*http.Cookie{
+      &http.Cookie{Name: "shared", Value: "new"},
+      &http.Cookie{Name: "newonly", Value: "2"},
+    })
+
+    if err := m.ChangeCookiesId("bill", "bob"); err != test.Err {
+      t.Errorf("Policy %d Expected: %v Got: %v", test.Policy, test.Err, err)
+    }
+    if c, _ := m.GetCookie("bob", "shared"); c == nil || c.Value != test.Shared {
+      t.Errorf("Policy %d Expected: %s Got: %v", test.Policy, test.Shared, c)
+    }
+    if _, err := m.GetCookie("bob", "newonly"); err != nil {
+      t.Errorf("Policy %d lost the new id's own cookie", test.Policy)
+    }
+    _, err := m.GetCookie("bob", "oldonly")
+    if (test.Err == nil) != (err == nil) {
+      t.Errorf("Policy %d moved the old id's cookie: %v", test.Policy, err == nil)
+    }
+    _, err = m.GetCookie("bill", "oldonly")
+    if (test.Err == nil) != (err != nil) {
+      t.Errorf("Policy %d kept the old id: %v", test.Policy, err == nil)
+    }
+  }
+}
+
+func TestMemoryCacheChangeIdGrace(t *testing.T) {
+  m, clock := newClockedMemoryCache(0, time.Hour)
+  m.SetCookie("bill", &http.Cookie{Name: "a", Value: "1"})
+  if err := m.ChangeCookiesId("bill", "bob"); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if _, err := m.GetCookie("bob", "a"); err != nil {
+    t.Error("The cookies were not merged into the new id")
+  }
+
+  //reading the old id must not extend it past the grace period
+  clock.t = clock.t.Add(DefaultOldIdGrace / 2)
+  if _, err := m.GetCookie("bill", "a"); err != nil {
+    t.Error("The old id should work during the grace period")
+  }
+  clock.t = clock.t.Add(DefaultOldIdGrace / 2)
+  if _, err := m.GetCookie("bill", "a"); err != ErrCookieNotFound {
+    t.Errorf("Expected the old id to expire after the grace period Got: %v", err)
+  }
+  if _, err := m.GetCookie("bob", "a"); err != nil {
+    t.Error("The new id expired with the old id")
+  }
+}
+
+func TestMemoryCacheLRU(t *testing.T) {
+  m, _ := newClockedMemoryCache(2, 0)
+  m.SetCookie("a", &http.Cookie{Name: "n", Value: "a"})
+  m.SetCookie("b", &http.Cookie{Name: "n", Value: "b"})
+  m.GetCookies("a")
+  m.SetCookie("c", &http.Cookie{Name: "n", Value: "c"})
+
+  if c, _ := m.GetCookies("b"); len(c) != 0 {
+    t.Error("The least recently used session was not evicted")
+  }
+  for _, id := range []string{"a", "c"} {
+    if c, _ := m.GetCookies(id); len(c) != 1 {
+      t.Errorf("Session %s should still be cached", id)
+    }
+  }
+  s := m.Stats()
+  if s.Sessions != 2 || s.Evictions != 1 {
+    t.Errorf("Expected: 2 sessions and 1 eviction Got: %+v", s)
+  }
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+  m, clock := newClockedMemoryCache(0, time.Minute)
+  m.SetCookie("a", &http.Cookie{Name: "n", Value: "a"})
+  m.SetCookie("b", &http.Cookie{Name: "n", Value: "b"})
+
+  //using a session keeps it alive
+  clock.t = clock.t.Add(40 * time.Second)
+  m.GetCookies("a")
+  clock.t = clock.t.Add(40 * time.Second)
+
+  if c, _ := m.GetCookies("a"); len(c) != 1 {
+    t.Error("A session in use should not expire")
+  }
+  if c, _ := m.GetCookies("b"); len(c) != 0 {
+    t.Error("An idle session should expire")
+  }
+  s := m.Stats()
+  if s.Expirations != 1 || s.Hits != 2 || s.Misses != 1 {
+    t.Errorf("Expected: 1 expiration 2 hits 1 miss Got: %+v", s)
+  }
+}
+
+func TestMemoryCacheRemovesExpiredOnInsert(t *testing.T) {
+  m, clock := newClockedMemoryCache(0, time.Millisecond)
+  for i := 0; i < 1000; i++ {
+    m.SetCookie(fmt.Sprint(i), &http.Cookie{Name: "n", Value: "v"})
+  }
+  clock.t = clock.t.Add(time.Second)
+  m.SetCookie("new", &http.Cookie{Name: "n", Value: "v"})
+
+  s := m.Stats()
+  if s.Sessions != 1 || s.Expirations != 1000 {
+    t.Errorf("Expected: 1 session and 1000 expirations Got: %+v", s)
+  }
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+  m := NewMemoryCache(50, time.Minute)
+  var wg sync.WaitGroup
+  for i := 0; i < 8; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      for j := 0; j < 200; j++ {
+        id := fmt.Sprintf("session-%d", (i * j) % 80)
+        m.SetCookie(id, &http.Cookie{Name: "n", Value: id})
+        m.GetCookies(id)
+        m.ChangeCookiesId(id, id + "-new")
+        m.DeleteCookie(id + "-new", "n")
+      }
+    }(i)
+  }
+  wg.Wait()
+  if s := m.Stats(); s.Sessions > 50 {
+    t.Errorf("The cache grew past its limit: %d", s.Sessions)
+  }
+}
@@ -28,16 +28,53 @@ type ResponseInfo struct {
   Body string
 }
 
+//Outcomes of the staging leg recorded in a Message
+const (
+  //OutcomeOK means staging returned a response
+  OutcomeOK = "ok"
+  //OutcomeTimeout means staging did not respond before the
+  //staging timeout, StagingReponse is left empty
+  OutcomeTimeout = "timeout"
+  //OutcomeSkipped means the request was not sent to staging,
+  //SkipReason says why and only the production side is set
+  OutcomeSkipped = "skipped"
+)
+
 type Message struct {
   ProdRequest RequestInfo
   StagingRequest RequestInfo
   ProdReponse ResponseInfo
   StagingReponse ResponseInfo
+  //Outcome tells how the staging leg ended
+  Outcome string
+  //Target is the name of the staging target, it is empty
+  //when there is only one
+  Target string
+  //Mirrored is false if the request was not sent to staging
+  Mirrored bool
+  //SkipReason says why a request was not mirrored
+  SkipReason string
+  //ProdSessionId is the production session id of the request,
+  //after any change made by the production response
+  ProdSessionId string
+  //StagingSessionId is the id of the staging session the
+  //production session is mirrored into
+  StagingSessionId string
+  //ProdTruncated is true if ProdReponse holds only the first
+  //MaxResponseCapture bytes of the production body.  Staging's
+  //body is then compared up to the same length
+  ProdTruncated bool
+  //Diff is the result of comparing the responses, it is nil
+  //if the proxy has no Comparator or staging did not respond
+  Diff *DiffResult
 }
 
 //NewRequestInfo generates the proper RequestInfo for
 //the given http.Request
 func NewRequestInfo(r *http.Request) RequestInfo {
+  if r.Body == nil {
+    return RequestInfo{Method: r.Method, URI: r.URL.String(), Header: r.Header}
+  }
   b, err := ioutil.ReadAll(r.Body)
   if  err != nil {
     return RequestInfo{Method: r.Method, URI: r.URL.String(), Header: r.Header}
@@ -58,5 +95,7 @@ func NewMessage(p *httptest.ResponseRecorder, s *httptest.ResponseRecorder,
     ProdRequest: NewRequestInfo(pr),
     StagingRequest: NewRequestInfo(sr),
     ProdReponse: NewResponseInfo(p),
-    StagingReponse: NewResponseInfo(s)}
+    StagingReponse: NewResponseInfo(s),
+    Outcome: OutcomeOK,
+    Mirrored: true}
 }
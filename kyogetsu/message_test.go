@@ -111,16 +111,16 @@ func TestNewRequestInfoWithoutBody(t *testing.T) {
 func TestNewMessage(t *testing.T) {
   var tests = []Message {
       {
-        RequestInfo{"POST", "example.com", http.Header{"Cookie": {"Prod Request"}}, "This is a prod test"},
-        RequestInfo{"POST", "example.com", http.Header{"Cookie": {"Staging Resquest"}}, "This is a staging test"},
-        ResponseInfo{301, http.Header{"Cookie": {"Prod Response"}}, "Prod"},
-        ResponseInfo{302, http.Header{"Cookie": {"Staging Response"}}, "Test"},
+        ProdRequest: RequestInfo{"POST", "example.com", http.Header{"Cookie": {"Prod Request"}}, "This is a prod test"},
+        StagingRequest: RequestInfo{"POST", "example.com", http.Header{"Cookie": {"Staging Resquest"}}, "This is a staging test"},
+        ProdReponse: ResponseInfo{301, http.Header{"Cookie": {"Prod Response"}}, "Prod"},
+        StagingReponse: ResponseInfo{302, http.Header{"Cookie": {"Staging Response"}}, "Test"},
       },
       {
-        RequestInfo{"GET", "test.com", http.Header{}, "this is also a prod test" },
-        RequestInfo{"GET", "test.com", http.Header{"Size": {"Not Empty"}}, "this is also a staging test" },
-        ResponseInfo{200, http.Header{"Cookie": {"A"}}, ""},
-        ResponseInfo{404, http.Header{"Cookie": {"A"}}, ""},
+        ProdRequest: RequestInfo{"GET", "test.com", http.Header{}, "this is also a prod test" },
+        StagingRequest: RequestInfo{"GET", "test.com", http.Header{"Size": {"Not Empty"}}, "this is also a staging test" },
+        ProdReponse: ResponseInfo{200, http.Header{"Cookie": {"A"}}, ""},
+        StagingReponse: ResponseInfo{404, http.Header{"Cookie": {"A"}}, ""},
       },
     }
   for _, test := range tests {
@@ -18,10 +18,10 @@ import (
 func TestSendMessageBadUrl(t *testing.T) {
   ns := NewNatsSender("bad url", "subject")
   m := Message{
-    RequestInfo{"POST", "bad url", http.Header{"Cookie": {"A"}}, "body"},
-    RequestInfo{"POST", "bad url", http.Header{"Cookie": {"A"}}, "body"},
-    ResponseInfo{200, http.Header{"Cookie": {"A"}}, "prod"},
-    ResponseInfo{200, http.Header{"Cookie": {"A"}}, "test"},
+    ProdRequest: RequestInfo{"POST", "bad url", http.Header{"Cookie": {"A"}}, "body"},
+    StagingRequest: RequestInfo{"POST", "bad url", http.Header{"Cookie": {"A"}}, "body"},
+    ProdReponse: ResponseInfo{200, http.Header{"Cookie": {"A"}}, "prod"},
+    StagingReponse: ResponseInfo{200, http.Header{"Cookie": {"A"}}, "test"},
   }
   err := ns.SendMessage(&m)
   if err == nil {
@@ -41,16 +41,16 @@ func TestSendMessage(t *testing.T) {
       Msg Message
     }{
       {"test", Message{
-        RequestInfo{"POST", "example.com", http.Header{"Header": {"Yes"}}, "testing"},
-        RequestInfo{"POST", "example.com", http.Header{"Header": {"No"}}, "testing"},
-        ResponseInfo{200, http.Header{}, "prod"},
-        ResponseInfo{200, http.Header{}, "test"},
+        ProdRequest: RequestInfo{"POST", "example.com", http.Header{"Header": {"Yes"}}, "testing"},
+        StagingRequest: RequestInfo{"POST", "example.com", http.Header{"Header": {"No"}}, "testing"},
+        ProdReponse: ResponseInfo{200, http.Header{}, "prod"},
+        StagingReponse: ResponseInfo{200, http.Header{}, "test"},
       }},
       {"BOB", Message{
-        RequestInfo{"GET", "testing.now", http.Header{}, "what are you doing?"},
-        RequestInfo{"GET", "testing.now", http.Header{}, "what are you doing?"},
-        ResponseInfo{200, http.Header{"Simple": {"B"}}, "serving people"},
-        ResponseInfo{200, http.Header{"Complex": {"B * 2i"}}, "testing code"},
+        ProdRequest: RequestInfo{"GET", "testing.now", http.Header{}, "what are you doing?"},
+        StagingRequest: RequestInfo{"GET", "testing.now", http.Header{}, "what are you doing?"},
+        ProdReponse: ResponseInfo{200, http.Header{"Simple": {"B"}}, "serving people"},
+        StagingReponse: ResponseInfo{200, http.Header{"Complex": {"B * 2i"}}, "testing code"},
       }},
     }
   for _, test := range tests {
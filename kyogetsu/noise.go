@@ -0,0 +1,300 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "net/http/httputil"
+  "net/url"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+)
+
+//A SecondaryProductionHandler is a ProxyHandler with a second
+//production instance.  When the proxy has a Comparator each
+//mirrored request is also sent to it, and the differences
+//between the two production responses are learned as noise
+//and left out of the staging DiffResult.  Only GET, HEAD,
+//OPTIONS and TRACE requests are sent to the secondary instance
+//unless Options.SecondaryWrites is set
+type SecondaryProductionHandler interface {
+  ProxyHandler
+  SecondaryProduction(*http.Request) *httputil.ReverseProxy
+}
+
+//DualProductionHandler is a stuct that impliments the
+//SecondaryProductionHandler, adding a fixed secondary
+//production ReverseProxy to a ProxyHandler
+type DualProductionHandler struct {
+  ProxyHandler
+  SecondaryProxy *httputil.ReverseProxy
+}
+
+//SecondaryProduction returns the SecondaryProxy
+func (p DualProductionHandler) SecondaryProduction(*http.Request) *httputil.ReverseProxy {
+  return p.SecondaryProxy
+}
+
+//StagingTargets returns the targets of the ProxyHandler if it
+//is a MultiStagingHandler, otherwise its single staging proxy
+func (p DualProductionHandler) StagingTargets(r *http.Request) []StagingTarget {
+  if m, ok := p.ProxyHandler.(MultiStagingHandler); ok {
+    return m.StagingTargets(r)
+  }
+  return []StagingTarget{{Proxy: p.Staging(r)}}
+}
+
+//NewDualProductionHandler returns a new DualProductionHandler by
+//parsing the URL strings p, p2 and s, storing them in
+//Production, SecondaryProduction and Staging respectively
+func NewDualProductionHandler(p string, p2 string, s string) DualProductionHandler {
+  pURL, _ := url.Parse(p2)
+  return DualProductionHandler{ProxyHandler: NewSingleProxyHandler(p, s),
+                               SecondaryProxy: httputil.NewSingleHostReverseProxy(pURL)}
+}
+
+//DefaultMaxNoiseRoutes is the number of routes the NoiseModel
+//of a KyogetsuProxy learns when Options.Noise is not set
+const DefaultMaxNoiseRoutes = 1000
+
+var noiseIdSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{16,}|` +
+  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+//DefaultNoiseRoute is the route noise is learned for when
+//Options.NoiseRoute is not set, the method and the path with
+//each segment that looks like an id, a number, a UUID or a
+//long hex string, replaced by *.  So GET /users/42 and
+//GET /users/43 are both GET /users/*
+func DefaultNoiseRoute(r *http.Request) string {
+  segs := strings.Split(r.URL.Path, "/")
+  for i, s := range segs {
+    if noiseIdSegment.MatchString(s) {
+      segs[i] = "*"
+    }
+  }
+  return r.Method + " " + strings.Join(segs, "/")
+}
+
+//RouteNoise is the noise learned for a route.  Body holds the
+//paths of the BodyDiffs with array indexes replaced by [*], so
+//JSON paths can be used as JSONComparator.Ignore rules
+type RouteNoise struct {
+  //Samples is the number of production pairs compared
+  Samples int
+  //Status is true if the production status codes differed
+  Status bool
+  Headers []string
+  Body []string
+}
+
+//NoiseModel holds the noise learned for each route.  It is
+//safe for concurrent use
+type NoiseModel struct {
+  mu sync.Mutex
+  maxRoutes int
+  routes map[string]*routeNoise
+}
+
+type routeNoise struct {
+  samples int
+  status bool
+  headers map[string]bool
+  body map[string]bool
+}
+
+//NewNoiseModel returns an empty NoiseModel that learns the
+//noise of at most maxRoutes routes.  Once it is full the
+//differences of new routes are not learned.  A maxRoutes of
+//zero disables the limit
+func NewNoiseModel(maxRoutes int) *NoiseModel {
+  return &NoiseModel{maxRoutes: maxRoutes, routes: map[string]*routeNoise{}}
+}
+
+var noiseIndex = regexp.MustCompile(`\[[0-9]+\]`)
+
+//noisePath replaces the array indexes of a body path with [*]
+func noisePath(p string) string {
+  return noiseIndex.ReplaceAllString(p, "[*]")
+}
+
+//Learn records the differences in d, the result of comparing
+//two production responses, as noise for route
+func (n *NoiseModel) Learn(route string, d *DiffResult) {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  rn, ok := n.routes[route]
+  if !ok && n.maxRoutes > 0 && len(n.routes) >= n.maxRoutes {
+    return
+  }
+  if !ok {
+    rn = &routeNoise{headers: map[string]bool{}, body: map[string]bool{}}
+    n.routes[route] = rn
+  }
+  rn.samples++
+  if d.StatusMismatch {
+    rn.status = true
+  }
+  for _, h := range d.Headers {
+    rn.headers[http.CanonicalHeaderKey(h.Name)] = true
+  }
+  for _, b := range d.Body {
+    rn.body[noisePath(b.Path)] = true
+  }
+}
+
+//Filter returns a copy of d without the differences learned as
+//noise for route.  A body difference is also noise if it is
+//inside a noisy JSON value
+func (n *NoiseModel) Filter(route string, d *DiffResult) *DiffResult {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  rn, ok := n.routes[route]
+  if !ok || d == nil {
+    return d
+  }
+  f := &DiffResult{ProdStatus: d.ProdStatus, StagingStatus: d.StagingStatus,
+                   StatusMismatch: d.StatusMismatch && !rn.status,
+                   Headers: []HeaderDiff{}, Body: []BodyDiff{}}
+  for _, h := range d.Headers {
+    if !rn.headers[http.CanonicalHeaderKey(h.Name)] {
+      f.Headers = append(f.Headers, h)
+    }
+  }
+  for _, b := range d.Body {
+    if !rn.noisyBody(noisePath(b.Path)) {
+      f.Body = append(f.Body, b)
+    }
+  }
+  f.Match = !f.StatusMismatch && len(f.Headers) == 0 && len(f.Body) == 0
+  return f
+}
+
+func (rn *routeNoise) noisyBody(p string) bool {
+  for {
+    if rn.body[p] {
+      return true
+    }
+    i := strings.LastIndexAny(p, ".[")
+    if i <= 0 {
+      return false
+    }
+    p = p[:i]
+  }
+}
+
+//Export returns the noise learned so far, keyed by route
+func (n *NoiseModel) Export() map[string]RouteNoise {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  e := make(map[string]RouteNoise, len(n.routes))
+  for route, rn := range n.routes {
+    e[route] = RouteNoise{Samples: rn.samples, Status: rn.status,
+                          Headers: sortedKeys(rn.headers), Body: sortedKeys(rn.body)}
+  }
+  return e
+}
+
+func sortedKeys(m map[string]bool) []string {
+  s := make([]string, 0, len(m))
+  for k := range m {
+    s = append(s, k)
+  }
+  sort.Strings(s)
+  return s
+}
+
+//secondaryLeg sends a mirrored request to the secondary
+//production instance once, however many staging targets it
+//has, and learns the noise between the production responses
+type secondaryLeg struct {
+  p KyogetsuProxy
+  proxy *httputil.ReverseProxy
+  r *http.Request
+  pw *httptest.ResponseRecorder
+  truncated bool
+  route string
+  once sync.Once
+  done chan struct{}
+}
+
+//secondaryLeg returns the secondary leg of r, or nil if there
+//is nothing to learn noise for.  Writes, unless they are
+//allowed, and requests whose body can not be read twice are
+//not sent to the secondary instance.
+//truncated tells whether pw holds only the start of the body
+func (p KyogetsuProxy) secondaryLeg(r *http.Request, pw *httptest.ResponseRecorder, truncated bool) *secondaryLeg {
+  h, ok := p.ph.(SecondaryProductionHandler)
+  if !ok || p.opts.Comparator == nil || p.noise == nil {
+    return nil
+  }
+  if !isReadMethod(r.Method) && !p.opts.SecondaryWrites {
+    return nil
+  }
+  if r.GetBody == nil && r.Body != nil && r.Body != http.NoBody {
+    return nil
+  }
+  proxy := h.SecondaryProduction(r)
+  if proxy == nil {
+    return nil
+  }
+  route := DefaultNoiseRoute
+  if p.opts.NoiseRoute != nil {
+    route = p.opts.NoiseRoute
+  }
+  return &secondaryLeg{p: p, proxy: proxy, r: r, pw: pw, truncated: truncated,
+                       route: route(r), done: make(chan struct{})}
+}
+
+//start sends the request to the secondary instance in the
+//background the first time it is called, so it runs at the
+//same time as the staging requests
+func (l *secondaryLeg) start() {
+  l.once.Do(func() {
+    go func() {
+      defer close(l.done)
+      l.learn()
+    }()
+  })
+}
+
+//wait blocks until the request sent by start has been learned
+//from.  The request body must stay readable until it returns
+func (l *secondaryLeg) wait() {
+  <-l.done
+}
+
+//learn sends the request to the secondary instance and learns
+//the differences from the production response
+func (l *secondaryLeg) learn() {
+  ctx, cancel := l.p.stagingContext(l.r)
+  defer cancel()
+  sr, _ := http.NewRequestWithContext(ctx, l.r.Method, l.r.URL.String(), newBody(l.r))
+  sr.ContentLength = l.r.ContentLength
+  sr.Host = l.r.Host
+  sr.Header = l.r.Header.Clone()
+  sw := httptest.NewRecorder()
+  l.proxy.ServeHTTP(sw, sr)
+  if ctx.Err() == context.DeadlineExceeded {
+    return
+  }
+  prod2 := NewResponseInfo(sw)
+  if l.truncated {
+    prod2 = capBody(prod2, l.p.opts.MaxResponseCapture)
+  }
+  d := l.p.opts.Comparator.Compare(l.r, NewResponseInfo(l.pw), prod2)
+  l.p.noise.Learn(l.route, d)
+}
+
+//filter waits for the secondary instance and removes the
+//noise of the route from d
+func (l *secondaryLeg) filter(d *DiffResult) *DiffResult {
+  l.wait()
+  return l.p.noise.Filter(l.route, d)
+}
@@ -0,0 +1,255 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+  )
+
+func TestNoiseModel(t *testing.T) {
+  n := NewNoiseModel(0)
+  n.Learn("GET /a", &DiffResult{Headers: []HeaderDiff{{Name: "X-Trace"}},
+                                Body: []BodyDiff{{Path: "$.items[3].t"}, {Path: "$.meta"}}})
+  n.Learn("GET /b", &DiffResult{StatusMismatch: true})
+
+  tests := []struct {
+    Route string
+    Diff DiffResult
+    Match bool
+    Headers string
+    Body string
+  } {
+    {"GET /a", DiffResult{Headers: []HeaderDiff{{Name: "x-trace"}}, Body: []BodyDiff{{Path: "$.items[0].t"},
+      {Path: "$.meta.id"}}}, true, "[]", "[]"},
+    {"GET /a", DiffResult{Headers: []HeaderDiff{{Name: "X-Other"}}, Body: []BodyDiff{{Path: "$.items[0].v"},
+      {Path: "$.metadata"}}}, false, "[{X-Other [] []}]", "[{$.items[0].v  } {$.metadata  }]"},
+    {"GET /a", DiffResult{StatusMismatch: true}, false, "[]", "[]"},
+    {"GET /b", DiffResult{StatusMismatch: true}, true, "[]", "[]"},
+    {"GET /c", DiffResult{Body: []BodyDiff{{Path: "$.meta"}}}, false, "[]", "[{$.meta  }]"},
+  }
+  for _, test := range tests {
+    d := n.Filter(test.Route, &test.Diff)
+    if d.Match != test.Match {
+      t.Errorf("%s: Match Expected: %t Got: %+v", test.Route, test.Match, d)
+    }
+    if h := fmt.Sprint(d.Headers); h != test.Headers {
+      t.Errorf("%s: Headers Expected: %s Got: %s", test.Route, test.Headers, h)
+    }
+    if b := fmt.Sprint(d.Body); b != test.Body {
+      t.Errorf("%s: Body Expected: %s Got: %s", test.Route, test.Body, b)
+    }
+  }
+
+  e := n.Export()
+  if s := fmt.Sprint(e["GET /a"]); s != "{1 false [X-Trace] [$.items[*].t $.meta]}" {
+    t.Errorf("Export Got: %s", s)
+  }
+  if s := fmt.Sprint(e["GET /b"]); s != "{1 true [] []}" {
+    t.Errorf("Export Got: %s", s)
+  }
+}
+
+func TestNoiseModelMaxRoutes(t *testing.T) {
+  n := NewNoiseModel(2)
+  for _, route := range []string{"GET /a", "GET /b", "GET /c", "GET /a"} {
+    n.Learn(route, &DiffResult{Body: []BodyDiff{{Path: "$.t"}}})
+  }
+  e := n.Export()
+  if len(e) != 2 || e["GET /a"].Samples != 2 {
+    t.Errorf("Expected GET /a and GET /b to be learned Got: %+v", e)
+  }
+  d := n.Filter("GET /c", &DiffResult{Body: []BodyDiff{{Path: "$.t"}}})
+  if d.Match {
+    t.Error("A route over the limit should not have noise")
+  }
+}
+
+func TestDefaultNoiseRoute(t *testing.T) {
+  tests := []struct {
+    Method string
+    Path string
+    Expected string
+  } {
+    {"GET", "/users", "GET /users"},
+    {"GET", "/users/42", "GET /users/*"},
+    {"DELETE", "/v2/users/42/posts/7", "DELETE /v2/users/*/posts/*"},
+    {"GET", "/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "GET /orders/*"},
+    {"GET", "/blobs/0123456789abcdef0123", "GET /blobs/*"},
+    {"GET", "/blobs/cafe", "GET /blobs/cafe"},
+  }
+  for _, test := range tests {
+    r, _ := http.NewRequest(test.Method, "http://example.com" + test.Path, nil)
+    if got := DefaultNoiseRoute(r); got != test.Expected {
+      t.Errorf("%s %s: Expected: %s Got: %s", test.Method, test.Path, test.Expected, got)
+    }
+  }
+}
+
+//newJSONServer returns a server that answers with a JSON body
+//whose t is different on every server and v is given
+func newJSONServer(name string, v int) *httptest.Server {
+  return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    fmt.Fprintf(w, `{"t": "%s", "v": %d}`, name, v)
+  }))
+}
+
+func TestSecondaryProductionLearnsNoise(t *testing.T) {
+  ps := newJSONServer("prod", 1)
+  defer ps.Close()
+  ps2 := newJSONServer("prod2", 1)
+  defer ps2.Close()
+  ss := newJSONServer("staging", 2)
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  k := NewKyogetsuProxyWithOptions(NewDualProductionHandler(ps.URL, ps2.URL, ss.URL), ms, getMemoryCache(),
+                                   CookieIdFunction("id"),
+                                   Options{Comparator: ResponseComparator{Body: JSONComparator{}}})
+  r, _ := http.NewRequest("GET", ps.URL + "/users", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+
+  m := waitMessage(t, ms)
+  if m.Diff == nil || m.Diff.Match {
+    t.Fatalf("Expected a difference Got: %+v", m.Diff)
+  }
+  if b := fmt.Sprint(m.Diff.Body); b != "[{$.v 1 2}]" {
+    t.Errorf("Expected only $.v to differ Got: %s", b)
+  }
+  if s := fmt.Sprint(k.Noise()); s != "map[GET /users:{1 false [] [$.t]}]" {
+    t.Errorf("Noise Got: %s", s)
+  }
+}
+
+func TestSecondaryProductionNeedsComparator(t *testing.T) {
+  ps := newJSONServer("prod", 1)
+  defer ps.Close()
+  calls := make(chan struct{}, 1)
+  ps2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    calls <- struct{}{}
+  }))
+  defer ps2.Close()
+  ss := newJSONServer("staging", 1)
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  k := NewKyogetsuProxy(NewDualProductionHandler(ps.URL, ps2.URL, ss.URL), ms, getMemoryCache(),
+                        CookieIdFunction("id"))
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+  waitMessage(t, ms)
+  if len(calls) != 0 {
+    t.Error("The secondary production instance was called without a Comparator")
+  }
+}
+
+func TestSecondaryProductionTruncatedBody(t *testing.T) {
+  body := `{"v": "` + strings.Repeat("x", 100) + `"}`
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprint(w, body)
+  }))
+  defer s.Close()
+
+  ms := make(chanSender, 1)
+  k := NewKyogetsuProxyWithOptions(NewDualProductionHandler(s.URL, s.URL, s.URL), ms, getMemoryCache(),
+                                   CookieIdFunction("id"),
+                                   Options{Comparator: ResponseComparator{}, MaxResponseCapture: 10})
+  r, _ := http.NewRequest("GET", s.URL + "/", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+
+  waitMessage(t, ms)
+  if n := k.Noise()["GET /"]; n.Samples != 1 || len(n.Body) != 0 {
+    t.Errorf("Expected no noise from identical responses Got: %+v", n)
+  }
+}
+
+func TestSecondaryProductionReadsOnly(t *testing.T) {
+  ps := newJSONServer("prod", 1)
+  defer ps.Close()
+  calls := make(chan string, 2)
+  ps2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    calls <- r.Method
+  }))
+  defer ps2.Close()
+  ss := newJSONServer("staging", 1)
+  defer ss.Close()
+
+  tests := []struct {
+    Method string
+    Writes bool
+    Sent bool
+  } {
+    {"GET", false, true},
+    {"POST", false, false},
+    {"DELETE", false, false},
+    {"POST", true, true},
+  }
+  for _, test := range tests {
+    ms := make(chanSender, 1)
+    k := NewKyogetsuProxyWithOptions(NewDualProductionHandler(ps.URL, ps2.URL, ss.URL), ms, getMemoryCache(),
+                                     CookieIdFunction("id"),
+                                     Options{Comparator: ResponseComparator{}, SecondaryWrites: test.Writes})
+    r, _ := http.NewRequest(test.Method, ps.URL + "/", nil)
+    k.ServeHTTP(httptest.NewRecorder(), r)
+    waitMessage(t, ms)
+    sent := false
+    select {
+    case <-calls:
+      sent = true
+    default:
+    }
+    if sent != test.Sent {
+      t.Errorf("%s Writes %t: Sent Expected: %t Got: %t", test.Method, test.Writes, test.Sent, sent)
+    }
+  }
+}
+
+func TestSecondaryProductionRunsWithStaging(t *testing.T) {
+  ps := newJSONServer("prod", 1)
+  defer ps.Close()
+  called := make(chan struct{}, 1)
+  ps2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    called <- struct{}{}
+    fmt.Fprint(w, `{"t": "prod2", "v": 1}`)
+  }))
+  defer ps2.Close()
+  //staging only answers once the secondary instance was called
+  parallel := make(chan bool, 1)
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-called:
+      parallel <- true
+    case <-time.After(time.Second):
+      parallel <- false
+    }
+    time.Sleep(100 * time.Millisecond)
+  }))
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  k := NewKyogetsuProxyWithOptions(NewDualProductionHandler(ps.URL, ps2.URL, ss.URL), ms, getMemoryCache(),
+                                   CookieIdFunction("id"),
+                                   Options{Comparator: ResponseComparator{Body: JSONComparator{}},
+                                           StagingTimeout: 50 * time.Millisecond})
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+
+  m := waitMessage(t, ms)
+  if !<-parallel {
+    t.Error("Expected the secondary instance to be called while staging was running")
+  }
+  if m.Outcome != OutcomeTimeout {
+    t.Errorf("Expected staging to time out Got: %s", m.Outcome)
+  }
+  if n := k.Noise()["GET /"]; n.Samples != 1 {
+    t.Errorf("Expected noise to be learned when staging times out Got: %+v", n)
+  }
+}
@@ -0,0 +1,317 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "hash/fnv"
+  "math/rand"
+  "net/http"
+  "regexp"
+  "strings"
+)
+
+//A MirrorPolicy decides if a request should be mirrored to
+//staging.  It is consulted before any staging work is queued
+type MirrorPolicy interface {
+  ShouldMirror(r *http.Request) bool
+}
+
+//RequestMatcher is a predicate on a request.  Used as a
+//MirrorPolicy it mirrors exactly the requests it matches
+type RequestMatcher func(*http.Request) bool
+
+//ShouldMirror reports whether m matches r
+func (m RequestMatcher) ShouldMirror(r *http.Request) bool {
+  return m(r)
+}
+
+//AlwaysMirror matches every request
+var AlwaysMirror RequestMatcher = func(*http.Request) bool { return true }
+
+//NeverMirror matches no request
+var NeverMirror RequestMatcher = func(*http.Request) bool { return false }
+
+//MatchMethods matches requests whose method is one of methods
+func MatchMethods(methods ...string) RequestMatcher {
+  return func(r *http.Request) bool {
+    for _, m := range methods {
+      if strings.EqualFold(r.Method, m) {
+        return true
+      }
+    }
+    return false
+  }
+}
+
+//MatchPathPrefix matches requests whose path starts with one
+//of prefixes
+func MatchPathPrefix(prefixes ...string) RequestMatcher {
+  return func(r *http.Request) bool {
+    for _, p := range prefixes {
+      if strings.HasPrefix(r.URL.Path, p) {
+        return true
+      }
+    }
+    return false
+  }
+}
+
+//MatchPathRegex matches requests whose path matches re
+func MatchPathRegex(re *regexp.Regexp) RequestMatcher {
+  return func(r *http.Request) bool {
+    return re.MatchString(r.URL.Path)
+  }
+}
+
+//MatchHeader matches requests that have the header name set
+//to value.  An empty value matches any request that has the
+//header
+func MatchHeader(name string, value string) RequestMatcher {
+  return func(r *http.Request) bool {
+    v, ok := r.Header[http.CanonicalHeaderKey(name)]
+    if !ok {
+      return false
+    }
+    if value == "" {
+      return true
+    }
+    for _, s := range v {
+      if s == value {
+        return true
+      }
+    }
+    return false
+  }
+}
+
+//SamplePolicy mirrors a random Percent of requests
+type SamplePolicy struct {
+  Percent float64
+}
+
+//ShouldMirror picks the request with a probability of Percent
+func (s SamplePolicy) ShouldMirror(*http.Request) bool {
+  return rand.Float64() * 100 < s.Percent
+}
+
+//NoIdMode decides how a SessionSamplePolicy treats requests
+//that do not carry a session id yet
+type NoIdMode int
+
+const (
+  //MirrorNoId mirrors every request without an id, so that
+  //flows such as a login reach staging.  Once the session is
+  //given an id it is kept only if that id is sampled
+  MirrorNoId NoIdMode = iota
+  //SkipNoId never mirrors requests without an id
+  SkipNoId
+  //SampleNoId mirrors requests without an id at random with
+  //the same Percent as sessions
+  SampleNoId
+)
+
+//A SessionPolicy is a MirrorPolicy that makes its choice per
+//session.  When a mirrored request is given a new session id
+//HandleStaging asks it whether the new session is sampled,
+//and keeps no staging cookies for sessions that are not.  It
+//is also asked when it is inside a RoutePolicy, HeaderPolicy,
+//AllOf, AnyOf or Not and applies to the request
+type SessionPolicy interface {
+  MirrorPolicy
+  ShouldMirrorSession(id string) bool
+}
+
+//SessionSamplePolicy mirrors Percent of sessions, hashing the
+//id found by IdFunc so that every request of a session is
+//either mirrored or skipped.  IdExtractor is used instead of
+//IdFunc when it is set, it should find the same id as the
+//proxy's.  NoId decides what happens to requests without an id
+type SessionSamplePolicy struct {
+  Percent float64
+  IdFunc IdFunction
+  IdExtractor IdExtractor
+  NoId NoIdMode
+}
+
+//ShouldMirror looks up the session id of r and reports whether
+//its session is sampled
+func (s SessionSamplePolicy) ShouldMirror(r *http.Request) bool {
+  var ex IdExtractor = s.IdFunc
+  if s.IdExtractor != nil {
+    ex = s.IdExtractor
+  }
+  id, err := ex.RequestId(r)
+  if err == nil {
+    return s.ShouldMirrorSession(id)
+  }
+  switch s.NoId {
+  case SkipNoId:
+    return false
+  case SampleNoId:
+    return SamplePolicy{s.Percent}.ShouldMirror(r)
+  }
+  return true
+}
+
+//ShouldMirrorSession reports whether the session id is sampled.
+//The same id always gives the same answer
+func (s SessionSamplePolicy) ShouldMirrorSession(id string) bool {
+  h := fnv.New64a()
+  h.Write([]byte(id))
+  return float64(h.Sum64() % 10000) < s.Percent * 100
+}
+
+//HeaderPolicy lets clients opt in or out of mirroring with a
+//header.  Requests whose Header equals OptIn are always
+//mirrored, those equal to OptOut never are, all others are
+//left to Default.  A nil Default mirrors the request
+type HeaderPolicy struct {
+  Header string
+  OptIn string
+  OptOut string
+  Default MirrorPolicy
+}
+
+//ShouldMirror applies the opt in, opt out and default rules
+func (h HeaderPolicy) ShouldMirror(r *http.Request) bool {
+  v := r.Header.Get(h.Header)
+  switch {
+  case v == "":
+  case v == h.OptIn:
+    return true
+  case v == h.OptOut:
+    return false
+  }
+  if h.Default == nil {
+    return true
+  }
+  return h.Default.ShouldMirror(r)
+}
+
+//Route pairs a RequestMatcher with the MirrorPolicy used for
+//the requests it matches
+type Route struct {
+  Match RequestMatcher
+  Policy MirrorPolicy
+}
+
+//RoutePolicy applies the Policy of the first Route that matches
+//the request, or Default if none do.  A nil Default mirrors
+//the request
+type RoutePolicy struct {
+  Routes []Route
+  Default MirrorPolicy
+}
+
+//ShouldMirror finds the request's route and applies its policy
+func (rp RoutePolicy) ShouldMirror(r *http.Request) bool {
+  for _, rt := range rp.Routes {
+    if rt.Match(r) {
+      return rt.Policy.ShouldMirror(r)
+    }
+  }
+  if rp.Default == nil {
+    return true
+  }
+  return rp.Default.ShouldMirror(r)
+}
+
+//AllOf returns a MirrorPolicy that mirrors a request only if
+//every one of policies does
+func AllOf(policies ...MirrorPolicy) MirrorPolicy {
+  return allOf(policies)
+}
+
+type allOf []MirrorPolicy
+
+func (a allOf) ShouldMirror(r *http.Request) bool {
+  for _, p := range a {
+    if !p.ShouldMirror(r) {
+      return false
+    }
+  }
+  return true
+}
+
+//AnyOf returns a MirrorPolicy that mirrors a request if any
+//one of policies does
+func AnyOf(policies ...MirrorPolicy) MirrorPolicy {
+  return anyOf(policies)
+}
+
+type anyOf []MirrorPolicy
+
+func (a anyOf) ShouldMirror(r *http.Request) bool {
+  for _, p := range a {
+    if p.ShouldMirror(r) {
+      return true
+    }
+  }
+  return false
+}
+
+//Not returns a MirrorPolicy that mirrors the requests p skips
+func Not(p MirrorPolicy) MirrorPolicy {
+  return not{p}
+}
+
+type not struct {
+  p MirrorPolicy
+}
+
+func (n not) ShouldMirror(r *http.Request) bool {
+  return !n.p.ShouldMirror(r)
+}
+
+//sessionDecision asks the SessionPolicies in p that apply to r
+//whether the session id that r is being given is mirrored.
+//decided is false if no SessionPolicy applies, the request was
+//then mirrored whatever its session
+func sessionDecision(p MirrorPolicy, r *http.Request, id string) (mirror bool, decided bool) {
+  switch v := p.(type) {
+  case nil:
+    return true, false
+  case SessionPolicy:
+    return v.ShouldMirrorSession(id), true
+  case RoutePolicy:
+    for _, rt := range v.Routes {
+      if rt.Match(r) {
+        return sessionDecision(rt.Policy, r, id)
+      }
+    }
+    return sessionDecision(v.Default, r, id)
+  case HeaderPolicy:
+    if h := r.Header.Get(v.Header); h != "" && (h == v.OptIn || h == v.OptOut) {
+      return h == v.OptIn, false
+    }
+    return sessionDecision(v.Default, r, id)
+  case allOf:
+    mirror = true
+    for _, c := range v {
+      m, ok := sessionDecision(c, r, id)
+      if ok {
+        decided = true
+        mirror = mirror && m
+      }
+    }
+    return mirror, decided
+  case anyOf:
+    for _, c := range v {
+      m, ok := sessionDecision(c, r, id)
+      if ok {
+        decided = true
+      } else {
+        m = c.ShouldMirror(r)
+      }
+      mirror = mirror || m
+    }
+    return mirror, decided
+  case not:
+    m, ok := sessionDecision(v.p, r, id)
+    return !m, ok
+  }
+  return true, false
+}
@@ -0,0 +1,236 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "regexp"
+  "testing"
+  "time"
+  )
+
+func newPolicyRequest(method string, path string, header ...string) *http.Request {
+  r, _ := http.NewRequest(method, "http://example.com" + path, nil)
+  for i := 0; i + 1 < len(header); i += 2 {
+    r.Header.Set(header[i], header[i + 1])
+  }
+  return r
+}
+
+func TestMirrorPolicies(t *testing.T) {
+  tests := []struct {
+    Name string
+    Policy MirrorPolicy
+    Request *http.Request
+    Expected bool
+  } {
+    {"always", AlwaysMirror, newPolicyRequest("GET", "/"), true},
+    {"never", NeverMirror, newPolicyRequest("GET", "/"), false},
+    {"method match", MatchMethods("GET", "head"), newPolicyRequest("HEAD", "/"), true},
+    {"method miss", MatchMethods("GET"), newPolicyRequest("POST", "/"), false},
+    {"prefix match", MatchPathPrefix("/api", "/search"), newPolicyRequest("GET", "/search?q=1"), true},
+    {"prefix miss", MatchPathPrefix("/api"), newPolicyRequest("GET", "/checkout"), false},
+    {"regex match", MatchPathRegex(regexp.MustCompile(`^/users/\d+$`)), newPolicyRequest("GET", "/users/12"), true},
+    {"regex miss", MatchPathRegex(regexp.MustCompile(`^/users/\d+$`)), newPolicyRequest("GET", "/users/bob"), false},
+    {"header present", MatchHeader("X-Test", ""), newPolicyRequest("GET", "/", "X-Test", "a"), true},
+    {"header value", MatchHeader("X-Test", "b"), newPolicyRequest("GET", "/", "X-Test", "a"), false},
+    {"sample none", SamplePolicy{0}, newPolicyRequest("GET", "/"), false},
+    {"sample all", SamplePolicy{100}, newPolicyRequest("GET", "/"), true},
+    {"opt in", HeaderPolicy{"X-Shadow", "1", "0", NeverMirror}, newPolicyRequest("GET", "/", "X-Shadow", "1"), true},
+    {"opt out", HeaderPolicy{"X-Shadow", "1", "0", nil}, newPolicyRequest("GET", "/", "X-Shadow", "0"), false},
+    {"opt default", HeaderPolicy{"X-Shadow", "1", "0", NeverMirror}, newPolicyRequest("GET", "/"), false},
+    {"all of", AllOf(AlwaysMirror, MatchMethods("GET")), newPolicyRequest("POST", "/"), false},
+    {"any of", AnyOf(NeverMirror, MatchMethods("GET")), newPolicyRequest("GET", "/"), true},
+    {"not", Not(MatchMethods("GET")), newPolicyRequest("GET", "/"), false},
+  }
+  for _, test := range tests {
+    if got := test.Policy.ShouldMirror(test.Request); got != test.Expected {
+      t.Errorf("%s: Expected: %t Got: %t", test.Name, test.Expected, got)
+    }
+  }
+}
+
+func TestRoutePolicy(t *testing.T) {
+  rp := RoutePolicy{
+    Routes: []Route{
+      {MatchPathPrefix("/checkout"), NeverMirror},
+      {MatchPathPrefix("/search"), SamplePolicy{100}},
+    },
+    Default: NeverMirror,
+  }
+  tests := []struct {
+    Path string
+    Expected bool
+  } {
+    {"/checkout/pay", false},
+    {"/search", true},
+    {"/other", false},
+  }
+  for _, test := range tests {
+    if got := rp.ShouldMirror(newPolicyRequest("GET", test.Path)); got != test.Expected {
+      t.Errorf("%s: Expected: %t Got: %t", test.Path, test.Expected, got)
+    }
+  }
+}
+
+func TestSamplePolicyRate(t *testing.T) {
+  s := SamplePolicy{25}
+  r := newPolicyRequest("GET", "/")
+  n := 0
+  for i := 0; i < 10000; i++ {
+    if s.ShouldMirror(r) {
+      n++
+    }
+  }
+  if n < 2000 || n > 3000 {
+    t.Errorf("Expected about 2500 of 10000 requests to be sampled Got: %d", n)
+  }
+}
+
+func TestServeHTTPHonorsMirrorPolicy(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+
+  ss := newStagingServer()
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  rc := getMemoryCache()
+  k := newTestKyogetsuProxy(ps, ss, ms, rc)
+  k.opts.MirrorPolicy = MatchPathPrefix("/search")
+
+  r, _ := http.NewRequest("GET", ps.URL + "/checkout", nil)
+  w := httptest.NewRecorder()
+  k.ServeHTTP(w, r)
+  if w.Body.String() != "Prod" {
+    t.Errorf("Expected: Prod Got: %s", w.Body.String())
+  }
+  select {
+  case <-ms:
+    t.Error("A request skipped by the policy should not be mirrored")
+  case <-time.After(100 * time.Millisecond):
+  }
+
+  r, _ = http.NewRequest("GET", ps.URL + "/search", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+  waitMessage(t, ms)
+}
+
+func TestSessionSamplePolicyIsConsistent(t *testing.T) {
+  s := SessionSamplePolicy{Percent: 50, IdFunc: CookieIdFunction("id")}
+  sampled := 0
+  for i := 0; i < 1000; i++ {
+    r := newPolicyRequest("GET", "/")
+    r.AddCookie(&http.Cookie{Name: "id", Value: fmt.Sprintf("session-%d", i)})
+    first := s.ShouldMirror(r)
+    for j := 0; j < 5; j++ {
+      if s.ShouldMirror(r) != first {
+        t.Fatalf("Session %d was not sampled consistently", i)
+      }
+    }
+    if first {
+      sampled++
+    }
+  }
+  if sampled < 400 || sampled > 600 {
+    t.Errorf("Expected about 500 of 1000 sessions to be sampled Got: %d", sampled)
+  }
+}
+
+func TestSessionSamplePolicyNoId(t *testing.T) {
+  tests := []struct {
+    Mode NoIdMode
+    Percent float64
+    Expected bool
+  } {
+    {MirrorNoId, 0, true},
+    {SkipNoId, 100, false},
+    {SampleNoId, 0, false},
+    {SampleNoId, 100, true},
+  }
+  for _, test := range tests {
+    s := SessionSamplePolicy{Percent: test.Percent, IdFunc: CookieIdFunction("id"), NoId: test.Mode}
+    if got := s.ShouldMirror(newPolicyRequest("GET", "/")); got != test.Expected {
+      t.Errorf("Mode %d: Expected: %t Got: %t", test.Mode, test.Expected, got)
+    }
+  }
+}
+
+func TestHandleStagingSkipsUnsampledNewSession(t *testing.T) {
+  tests := []struct {
+    Percent float64
+    Saved bool
+  } {
+    {0, false},
+    {100, true},
+  }
+  for _, test := range tests {
+    ps := newProdServer()
+    defer ps.Close()
+
+    ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      http.SetCookie(w, &http.Cookie{Name: "staging", Value: "session"})
+      fmt.Fprintf(w, "Staging")
+    }))
+    defer ss.Close()
+
+    fc := getMemoryCache()
+    ph := NewSingleProxyHandler(ps.URL, ss.URL)
+    k := NewKyogetsuProxyWithOptions(ph, make(chanSender, 1), fc, CookieIdFunction("id"), Options{
+      MirrorPolicy: SessionSamplePolicy{Percent: test.Percent, IdFunc: CookieIdFunction("id")},
+    })
+
+    r, _ := http.NewRequest("POST", ss.URL + "/login", nil)
+    pw := httptest.NewRecorder()
+    http.SetCookie(pw, &http.Cookie{Name: "id", Value: "new-session"})
+    k.HandleStaging(r, pw)
+
+    c, _ := fc.GetCookies("new-session")
+    if ok := len(c) > 0; ok != test.Saved {
+      t.Errorf("Percent %f: Saved Expected: %t Got: %t", test.Percent, test.Saved, ok)
+    }
+  }
+}
+
+func TestSessionDecisionCombinators(t *testing.T) {
+  never := SessionSamplePolicy{Percent: 0, IdFunc: CookieIdFunction("id")}
+  always := SessionSamplePolicy{Percent: 100, IdFunc: CookieIdFunction("id")}
+  checkout := MatchPathPrefix("/checkout")
+  tests := []struct {
+    Name string
+    Policy MirrorPolicy
+    Path string
+    Header string
+    Expected bool
+  } {
+    {"none", nil, "/", "", true},
+    {"plain", MatchMethods("GET"), "/", "", true},
+    {"session", never, "/", "", false},
+    {"route", RoutePolicy{Routes: []Route{{checkout, never}}, Default: always}, "/checkout", "", false},
+    {"route default", RoutePolicy{Routes: []Route{{checkout, never}}, Default: always}, "/search", "", true},
+    {"route plain", RoutePolicy{Routes: []Route{{checkout, never}}}, "/search", "", true},
+    {"all of", AllOf(MatchMethods("GET"), never), "/", "", false},
+    {"all of plain", AllOf(MatchMethods("GET"), Not(checkout)), "/", "", true},
+    {"any of", AnyOf(never, MatchPathPrefix("/search")), "/checkout", "", false},
+    {"any of plain", AnyOf(never, MatchPathPrefix("/search")), "/search", "", true},
+    {"not", Not(always), "/", "", false},
+    {"header default", HeaderPolicy{Header: "X-Mirror", OptIn: "1", Default: never}, "/", "", false},
+    {"header opt in", HeaderPolicy{Header: "X-Mirror", OptIn: "1", Default: never}, "/", "1", true},
+  }
+  for _, test := range tests {
+    r := newPolicyRequest("GET", test.Path)
+    if test.Header != "" {
+      r.Header.Set("X-Mirror", test.Header)
+    }
+    k := NewKyogetsuProxyWithOptions(SingleProxyHandler{}, dummySender{}, getMemoryCache(),
+                                     CookieIdFunction("id"), Options{MirrorPolicy: test.Policy})
+    if got := k.sessionSampled(r, "new-session"); got != test.Expected {
+      t.Errorf("%s: Expected: %t Got: %t", test.Name, test.Expected, got)
+    }
+  }
+}
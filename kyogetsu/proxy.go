@@ -6,11 +6,15 @@
 package kyogetsu
 
 import (
+  "context"
   "errors"
+  "io"
   "net/http"
   "net/http/httputil"
   "net/http/httptest"
   "net/url"
+  "reflect"
+  "time"
 )
 
 //ProxyHandler interface provides access to a
@@ -51,13 +55,13 @@ func NewSingleProxyHandler(p string, s string) SingleProxyHandler {
 }
 
 //IdFunction type provides a method of determining the session
-//id of the user.
+//id of the user from their cookies.  It is an IdExtractor
 type IdFunction func([]*http.Cookie) (string, error)
 
 //CookieIdFunction generates an IdFunction.  This function will for the
 //cookie whoes name matches the string provided and return it's value
 //as the session id
-func CookieIdFunction(s string) func([]*http.Cookie) (string, error) {
+func CookieIdFunction(s string) IdFunction {
   return func(c []*http.Cookie) (string, error) {
     for i := range c {
       if c[i].Name == s {
@@ -68,96 +72,594 @@ func CookieIdFunction(s string) func([]*http.Cookie) (string, error) {
   }
 }
 
+//DefaultMaxResponseCapture is the number of bytes of the
+//production response body kept for the Message when
+//Options.MaxResponseCapture is not set
+const DefaultMaxResponseCapture = 1 << 20
+
+//DefaultMaxRequestBody is the largest request body that is
+//captured and mirrored to staging when Options.MaxRequestBody
+//is not set
+const DefaultMaxRequestBody = 10 << 20
+
+//DefaultRequestSpillThreshold is the size above which captured
+//request bodies are kept in a temp file instead of in memory
+//when Options.RequestSpillThreshold is not set
+const DefaultRequestSpillThreshold = 64 << 10
+
+//DefaultStagingWorkers is the number of staging workers
+//used when Options.StagingWorkers is not set
+const DefaultStagingWorkers = 16
+
+//DefaultStagingQueueSize is the number of mirrors that can
+//wait for a staging worker when Options.StagingQueueSize is
+//not set
+const DefaultStagingQueueSize = 1024
+
+//DefaultBlockTimeout is how long the Block overflow policy
+//waits for room in the queue when Options.BlockTimeout is
+//not set
+const DefaultBlockTimeout = 50 * time.Millisecond
+
+//DefaultStagingTimeout is the longest a staging request may
+//take when Options.StagingTimeout is not set
+const DefaultStagingTimeout = 30 * time.Second
+
+//Options holds the optional settings of a KyogetsuProxy.
+//Any field left at its zero value uses the default
+type Options struct {
+  //MaxResponseCapture is the most bytes of the production
+  //response body that are copied into the Message.  The
+  //client always receives the full body.  A negative value
+  //captures the whole body
+  MaxResponseCapture int64
+  //MaxRequestBody is the largest request body that will be
+  //captured.  Requests with larger bodies are still sent to
+  //production but are not mirrored to staging.  A mirrored
+  //body is read in full before production is contacted, so
+  //large uploads reach production later than without the
+  //proxy.  Use a MirrorPolicy to leave upload routes out
+  MaxRequestBody int64
+  //RequestSpillThreshold is the size above which a captured
+  //request body is written to a temp file
+  RequestSpillThreshold int64
+  //TempDir is the directory used for spilled request bodies,
+  //the system default is used if it is empty
+  TempDir string
+  //StagingWorkers is the number of staging requests that can
+  //run at the same time
+  StagingWorkers int
+  //StagingQueueSize is the number of mirrors that can wait
+  //for a free staging worker
+  StagingQueueSize int
+  //Overflow decides what happens to a mirror when the staging
+  //queue is full.  The default is DropNewest
+  Overflow OverflowPolicy
+  //BlockTimeout is the longest the Block policy will wait
+  BlockTimeout time.Duration
+  //MaxSessionQueue is the number of mirrors of one session
+  //that can wait for the one ahead of them.  Mirrors of a
+  //session run in the order production saw them.  A negative
+  //value lets every mirror run as soon as a worker is free
+  MaxSessionQueue int
+  //MirrorPolicy decides which requests are mirrored to
+  //staging.  Every request is mirrored if it is nil
+  MirrorPolicy MirrorPolicy
+  //StagingTimeout is the longest a staging request may take
+  //before it is abandoned.  A negative value disables it
+  StagingTimeout time.Duration
+  //RouteTimeouts overrides StagingTimeout for the requests
+  //they match, the first match is used
+  RouteTimeouts []RouteTimeout
+  //Safety keeps unsafe requests away from staging and sets
+  //mandatory headers on staging requests.  Nothing is
+  //blocked if it is nil
+  Safety *SafetyPolicy
+  //IgnoredCookies are cookie names that are never saved to or
+  //loaded from the CookieCache.  Names may use path.Match
+  //patterns such as "_ga*"
+  IgnoredCookies []string
+  //StripIgnoredCookies also removes the ignored cookies from
+  //the headers recorded in the Message
+  StripIgnoredCookies bool
+  //CookieMode decides whether the client's own cookies are
+  //sent to staging next to the cached ones.  The default,
+  //ReplaceCookies, only sends the cached cookies
+  CookieMode CookieMode
+  //StagingCookieHost is the host the Domain of staging's
+  //cookies is matched against.  The host each staging target
+  //is sent is used if it is empty
+  StagingCookieHost string
+  //ClientCookies limits the client cookies forwarded to
+  //staging to the names matching one of its path.Match
+  //patterns.  Every client cookie may be forwarded if it is
+  //empty
+  ClientCookies []string
+  //SessionState stores the values found by CaptureRules for
+  //each session.  Nothing is captured if it is nil
+  SessionState SessionStateCache
+  //CaptureRules copy values such as tokens from staging
+  //responses into the following staging requests of the
+  //session
+  CaptureRules []CaptureRule
+  //IdExtractor finds the session id in place of the
+  //IdFunction given to the constructor, for ids that are not
+  //in a cookie such as HeaderId or JWTClaimId
+  IdExtractor IdExtractor
+  //StagingIdFunc finds staging's own session id, which is
+  //linked to the production id when the CookieCache is a
+  //SessionIdMap.  The proxy's IdExtractor is used if it is nil
+  StagingIdFunc IdExtractor
+  //Comparator compares the production and staging responses
+  //and attaches its DiffResult to the Message.  Nothing is
+  //compared if it is nil
+  Comparator Comparator
+  //Noise holds the noise learned from a
+  //SecondaryProductionHandler, a new NoiseModel of
+  //DefaultMaxNoiseRoutes routes is used if it is nil
+  Noise *NoiseModel
+  //NoiseRoute names the route noise is learned for, the
+  //default is DefaultNoiseRoute.  Requests whose differences
+  //are alike must share a route, so ids in the path should
+  //not be part of it
+  NoiseRoute func(*http.Request) string
+  //SecondaryWrites also sends requests that are not reads,
+  //such as POST or DELETE, to the secondary production
+  //instance.  Their side effects, such as payments or emails,
+  //then happen twice in production
+  SecondaryWrites bool
+}
+
+//RouteTimeout sets the staging timeout for the requests
+//matched by Match.  A Timeout of zero or less disables it
+type RouteTimeout struct {
+  Match RequestMatcher
+  Timeout time.Duration
+}
+
 //KyogetsuProxy contains all the data and functions to
 //make the Kyogetsu Proxy system work.
 type KyogetsuProxy struct {
   ph ProxyHandler
   ms MessageSender
   ccache CookieCache
+  state SessionStateCache
+  idMap SessionIdMap
   ignoredCookies []string
-  idFunc IdFunction
+  idFunc IdExtractor
+  opts Options
+  dispatcher *StagingDispatcher
+  sessions *SessionQueue
+  noise *NoiseModel
 }
 
 //NewKyogetsuProxy creates a new KyogetsuProxy with the
 //provided configuration
 func NewKyogetsuProxy(ph ProxyHandler, ms MessageSender, c CookieCache, idf IdFunction) KyogetsuProxy {
-  return KyogetsuProxy{ph: ph, ms: ms, ccache: c, idFunc: idf}
+  return NewKyogetsuProxyWithOptions(ph, ms, c, idf, Options{})
+}
+
+//NewKyogetsuProxyWithOptions creates a new KyogetsuProxy with
+//the provided configuration and optional settings.  idf may be
+//nil when Options.IdExtractor is set
+func NewKyogetsuProxyWithOptions(ph ProxyHandler, ms MessageSender, c CookieCache, idf IdFunction, o Options) KyogetsuProxy {
+  if o.MaxResponseCapture == 0 {
+    o.MaxResponseCapture = DefaultMaxResponseCapture
+  }
+  if o.MaxRequestBody == 0 {
+    o.MaxRequestBody = DefaultMaxRequestBody
+  }
+  if o.RequestSpillThreshold == 0 {
+    o.RequestSpillThreshold = DefaultRequestSpillThreshold
+  }
+  if o.StagingWorkers == 0 {
+    o.StagingWorkers = DefaultStagingWorkers
+  }
+  if o.StagingQueueSize == 0 {
+    o.StagingQueueSize = DefaultStagingQueueSize
+  }
+  if o.BlockTimeout == 0 {
+    o.BlockTimeout = DefaultBlockTimeout
+  }
+  if o.StagingTimeout == 0 {
+    o.StagingTimeout = DefaultStagingTimeout
+  }
+  if o.MaxSessionQueue == 0 {
+    o.MaxSessionQueue = DefaultMaxSessionQueue
+  }
+  d := NewStagingDispatcher(o.StagingWorkers, o.StagingQueueSize, o.Overflow, o.BlockTimeout)
+  var sq *SessionQueue
+  if o.MaxSessionQueue > 0 {
+    sq = NewSessionQueue(d, o.MaxSessionQueue)
+  }
+  var ex IdExtractor = idf
+  if o.IdExtractor != nil {
+    ex = o.IdExtractor
+  }
+  idMap, _ := c.(SessionIdMap)
+  noise := o.Noise
+  if _, ok := ph.(SecondaryProductionHandler); ok && noise == nil {
+    noise = NewNoiseModel(DefaultMaxNoiseRoutes)
+  }
+  return KyogetsuProxy{ph: ph, ms: ms, ccache: c, idFunc: ex, opts: o, dispatcher: d,
+                       sessions: sq, state: o.SessionState, idMap: idMap,
+                       ignoredCookies: o.IgnoredCookies, noise: noise}
 }
 
-//ServeHTTP sends the request to the production reverse proxy
-//then invokes the results to the HandleStaging method
+//Noise returns the noise learned from the secondary production
+//instance for each route, it is nil if there is none
+func (p KyogetsuProxy) Noise() map[string]RouteNoise {
+  if p.noise == nil {
+    return nil
+  }
+  return p.noise.Export()
+}
+
+//Stats returns the counters of the staging dispatcher,
+//including the number of dropped mirrors
+func (p KyogetsuProxy) Stats() DispatcherStats {
+  if p.sessions != nil {
+    return p.sessions.Stats()
+  }
+  return p.dispatcher.Stats()
+}
+
+//ServeHTTP sends the request to the production reverse proxy,
+//streaming the response straight to the client.  If the
+//MirrorPolicy selects the request its body, up to
+//MaxRequestBody, is captured before production is contacted
+//and HandleStaging is queued with a bounded copy of the
+//production response on the staging dispatcher
 func (p KyogetsuProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-  nr, _ := http.NewRequest(r.Method, r.URL.String(), r.Body)
+  if p.dispatcher.Closed() ||
+     p.opts.MirrorPolicy != nil && !p.opts.MirrorPolicy.ShouldMirror(r) {
+    p.ph.Production(r).ServeHTTP(w, r)
+    return
+  }
+
+  snap, _ := NewRequestSnapshot(r, p.opts.MaxRequestBody, p.opts.RequestSpillThreshold, p.opts.TempDir)
+  //the snapshot is closed here unless the staging work took it
+  //over, including when production panics with
+  //http.ErrAbortHandler because the client went away
+  owned := false
+  defer func() {
+    if !owned {
+      snap.Close()
+    }
+  }()
+  nr, _ := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), nil)
   nr.Header = r.Header
-  pw := httptest.NewRecorder()
+  nr.Host = r.Host
+  nr.Body = snap.NewReader()
+  nr.ContentLength = snap.Size()
+  nr.GetBody = snap.GetBody
+
+  pw := newTeeResponseWriter(w, p.opts.MaxResponseCapture)
   p.ph.Production(r).ServeHTTP(pw, r)
-  for k, v := range pw.HeaderMap {
-      w.Header()[k] = v
+
+  //a partial body would send staging a different request
+  if !snap.Complete() {
+    return
+  }
+  rec := pw.Recorded()
+  if reason := p.opts.Safety.Check(nr); reason != "" {
+    owned = true
+    p.dispatcher.Submit(func() {
+      defer snap.Close()
+      p.sendSkipped(nr, rec, pw.Truncated(), reason)
+    }, func() {
+      snap.Close()
+    })
+    return
+  }
+  targets := p.stagingTargets(r)
+  if len(targets) == 0 {
+    return
+  }
+  owned = true
+  release := releaseAfter(len(targets), func() { snap.Close() })
+  id, _ := p.idFunc.RequestId(r)
+  sec := p.secondaryLeg(nr.Clone(nr.Context()), rec, pw.Truncated())
+  for _, t := range targets {
+    t := t
+    tr := nr.Clone(nr.Context())
+    p.submit(t, id, func() {
+      defer release()
+      p.forTarget(t).handleTarget(t, tr, rec, pw.Truncated(), sec)
+    }, release)
+  }
+}
+
+//submit queues the staging work for target t of the session
+//id.  The work of a session runs in order unless session
+//ordering is disabled or the request has no id
+func (p KyogetsuProxy) submit(t StagingTarget, id string, run func(), drop func()) {
+  if p.sessions == nil || id == "" {
+    p.dispatcher.Submit(run, drop)
+    return
+  }
+  p.sessions.Submit(t.Name + "/" + id, run, drop)
+}
+
+//A Flusher is implemented by a MessageSender or CookieCache
+//that buffers writes
+type Flusher interface {
+  Flush() error
+}
+
+//Shutdown stops mirroring new requests and waits for the
+//staging work already queued to finish, up to ctx's deadline.
+//It then flushes and closes the MessageSender, CookieCache and
+//SessionStateCache if they implement Flusher or io.Closer.  Production traffic
+//keeps being served after Shutdown returns.
+//
+//If the staging work does not finish in time the error from
+//ctx is returned and nothing is flushed or closed, as the
+//staging work still running would lose its cookie updates and
+//messages.  Shutdown may be called again to wait longer.
+//Otherwise the first error from flushing or closing is returned
+func (p KyogetsuProxy) Shutdown(ctx context.Context) error {
+  p.dispatcher.Close()
+  if err := p.dispatcher.Wait(ctx); err != nil {
+    return err
+  }
+  var err error
+
+  //a value used for several roles is only flushed and closed once
+  caches := []interface{}{}
+  for _, v := range []interface{}{p.ms, p.ccache, p.state} {
+    seen := v == nil
+    for _, c := range caches {
+      seen = seen || sameValue(v, c)
+    }
+    if !seen {
+      caches = append(caches, v)
+    }
+  }
+  for _, v := range caches {
+    if f, ok := v.(Flusher); ok {
+      if ferr := f.Flush(); err == nil {
+        err = ferr
+      }
+    }
+    if c, ok := v.(io.Closer); ok {
+      if cerr := c.Close(); err == nil {
+        err = cerr
+      }
+    }
+  }
+  return err
+}
+
+//sameValue reports whether a and b hold the same value, without
+//panicking on values that can not be compared
+func sameValue(a interface{}, b interface{}) bool {
+  t := reflect.TypeOf(a)
+  return t != nil && t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+//newBody returns a fresh reader over the body of r if the
+//request supports it, otherwise the body itself
+func newBody(r *http.Request) io.ReadCloser {
+  if r.GetBody != nil {
+    if b, err := r.GetBody(); err == nil {
+      return b
+    }
   }
-  w.WriteHeader(pw.Code)
-  w.Write(pw.Body.Bytes())
-  go p.HandleStaging(nr, pw)
+  return r.Body
 }
 
 //loadCookies any cookie data stored in the CookieCache
 //and write it to the request, overriding any existing
-//values
-func (p KyogetsuProxy) loadCookies(id string, r *http.Request) error {
+//values.  Only cookies whose Path matches the request, whose
+//Domain matches host and that have not expired are sent.
+//Ignored cookies are never loaded.  With MergeCookies the
+//client's cookies that staging has not set are kept
+func (p KyogetsuProxy) loadCookies(id string, host string, r *http.Request) error {
   sc, err := p.ccache.GetCookies(id)
   if err != nil {
     return err
   }
 
+  now := time.Now()
+  var client []*http.Cookie
+  if p.opts.CookieMode == MergeCookies {
+    client = p.clientCookies(r)
+  }
   r.Header.Del("Cookie")
-  for _, v := range sc {
+  cached := map[string]bool{}
+  for _, v := range p.filterCookies(sc) {
+    if cookieExpired(v, now) || !cookieMatches(v, host, r.URL.Path) {
+      continue
+    }
     r.AddCookie(v)
+    cached[v.Name] = true
+  }
+  for _, v := range client {
+    if !cached[v.Name] {
+      r.AddCookie(v)
+    }
   }
   return nil
 }
 
+//stagingHost returns the host the Domain of the cookies of
+//target t is matched against, Options.StagingCookieHost if it
+//is set, otherwise the host the target's proxy sends r to
+func (p KyogetsuProxy) stagingHost(t StagingTarget, r *http.Request) string {
+  if p.opts.StagingCookieHost != "" {
+    return p.opts.StagingCookieHost
+  }
+  if t.Proxy != nil && t.Proxy.Director != nil {
+    //run the Director on a copy to see where r would go
+    r = r.Clone(r.Context())
+    t.Proxy.Director(r)
+  }
+  if r.Host != "" {
+    return r.Host
+  }
+  return r.URL.Host
+}
+
 //saveCookies saves any cookies in the Response to the CookieCache
 //if the session id is changed it will copy all the cookies
-//from the old id to the new id before overwriting them
+//from the old id to the new id before overwriting them.
+//Cookies that staging deletes, with a Max-Age of zero or an
+//Expires in the past, are removed.  Ignored cookies are
+//never saved
 func (p KyogetsuProxy) saveCookies(id string, w http.ResponseWriter) error {
   r := http.Response{Header: w.Header()}
-  c := r.Cookies()
+  c := p.filterCookies(r.Cookies())
+
+  //cookies the browser would remove are deleted from the cache
+  now := time.Now()
+  set := make([]*http.Cookie, 0, len(c))
+  del := []string{}
+  for _, v := range c {
+    if cookieDeleted(v, now) {
+      del = append(del, v.Name)
+    } else {
+      set = append(set, v)
+    }
+  }
 
-  err := p.ccache.SetCookies(id, c)
+  err := p.ccache.DeleteCookies(id, del)
+  if err != nil {
+    return err
+  }
+  err = p.ccache.SetCookies(id, set)
   if err != nil {
     return err
   }
   return nil
 }
 
-//HandleStaging prepares and send the request to the staging proxy
-//updates the cookies if needed and sends the results to the
-//message sender
+//sessionSampled asks the SessionPolicies of the MirrorPolicy
+//that apply to r whether the session id r is given is mirrored
+func (p KyogetsuProxy) sessionSampled(r *http.Request, id string) bool {
+  m, ok := sessionDecision(p.opts.MirrorPolicy, r, id)
+  return !ok || m
+}
+
+//stagingContext returns the context for the staging request
+//of r.  It keeps the values of r's context but not its
+//cancellation, since the client is usually gone by the time
+//staging runs, and applies the staging timeout for r's route
+func (p KyogetsuProxy) stagingContext(r *http.Request) (context.Context, context.CancelFunc) {
+  ctx := context.WithoutCancel(r.Context())
+  d := p.opts.StagingTimeout
+  for _, rt := range p.opts.RouteTimeouts {
+    if rt.Match(r) {
+      d = rt.Timeout
+      break
+    }
+  }
+  if d <= 0 {
+    return context.WithCancel(ctx)
+  }
+  return context.WithTimeout(ctx, d)
+}
+
+//HandleStaging prepares and send the request to each staging
+//target in turn, updates the cookies if needed and sends the
+//results to the message sender.  Requests the SafetyPolicy
+//rejects are reported as skipped instead
 func (p KyogetsuProxy) HandleStaging(r *http.Request, pw *httptest.ResponseRecorder) {
-  sr, _ := http.NewRequest(r.Method, r.URL.String(), r.Body)
+  if reason := p.opts.Safety.Check(r); reason != "" {
+    p.sendSkipped(r, pw, false, reason)
+    return
+  }
+  sec := p.secondaryLeg(r.Clone(r.Context()), pw, false)
+  for _, t := range p.stagingTargets(r) {
+    p.forTarget(t).handleTarget(t, r.Clone(r.Context()), pw, false, sec)
+  }
+}
+
+//handleTarget mirrors r to a single staging target.  truncated
+//tells whether pw holds only the start of the production body.
+//If sec is not nil it is sent to the secondary production
+//instance alongside staging and its noise is removed from the
+//diff
+func (p KyogetsuProxy) handleTarget(t StagingTarget, r *http.Request, pw *httptest.ResponseRecorder,
+                                    truncated bool, sec *secondaryLeg) {
+  if sec != nil {
+    sec.start()
+    //the secondary request reads the body until it is done
+    defer sec.wait()
+  }
+  ctx, cancel := p.stagingContext(r)
+  defer cancel()
+  sr, _ := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), newBody(r))
+  sr.ContentLength = r.ContentLength
+  sr.GetBody = r.GetBody
   for k, v := range r.Header {
       sr.Header[k] = v
   }
-  id, id_err := p.idFunc(r.Cookies())
+  p.opts.Safety.apply(sr)
+  id, id_err := p.idFunc.RequestId(r)
   if id_err == nil {
-    p.loadCookies(id, sr)
+    p.loadCookies(id, p.stagingHost(t, sr), sr)
+    p.loadState(id, sr)
+  } else if len(p.opts.ClientCookies) > 0 {
+    c := p.clientCookies(sr)
+    sr.Header.Del("Cookie")
+    for _, v := range c {
+      sr.AddCookie(v)
+    }
   }
 
   sw := httptest.NewRecorder()
-  p.ph.Staging(r).ServeHTTP(sw, sr)
+  t.Proxy.ServeHTTP(sw, sr)
+  timedOut := ctx.Err() == context.DeadlineExceeded
 
   //update id if a new id is given
-  resp := http.Response{Header: pw.Header()}
-  c := resp.Cookies()
-  if n, e := p.idFunc(c); e == nil && n != id {
-    //if the old id exists change update where the data is stored
-    if id_err == nil {
+  save := true
+  if n, e := p.idFunc.ResponseId(recordedResponse(pw, r)); e == nil && n != id {
+    if !p.sessionSampled(r, n) {
+      //the new session is not mirrored, its cookies are never used
+      save = false
+    } else if id_err == nil {
+      //if the old id exists change update where the data is stored
       p.ccache.ChangeCookiesId(id, n)
+      if p.state != nil {
+        p.state.ChangeStateId(id, n)
+      }
     }
     id = n
   }
 
-  p.saveCookies(id, sw)
+  sid := ""
+  if save {
+    p.saveCookies(id, sw)
+    if !timedOut && id != "" {
+      p.saveState(id, sw)
+    }
+    sid = p.stagingSessionId(id, sr, sw)
+  }
 
+  //the bodies were consumed by the proxies, give the
+  //Message its own copy
+  r.Body = newBody(r)
+  sr.Body = newBody(sr)
   m := NewMessage(pw, sw, r, sr)
-  p.ms.SendMessage(m)
+  m.Target = t.Name
+  m.ProdSessionId = id
+  m.StagingSessionId = sid
+  m.ProdTruncated = truncated
+  if timedOut {
+    //the response is the proxy's error page, not staging's
+    m.Outcome = OutcomeTimeout
+    m.StagingReponse = ResponseInfo{}
+  } else if p.opts.Comparator != nil {
+    staging := m.StagingReponse
+    if truncated {
+      //only the part of staging's body that production kept is compared
+      staging = capBody(staging, p.opts.MaxResponseCapture)
+    }
+    m.Diff = p.opts.Comparator.Compare(r, m.ProdReponse, staging)
+    if sec != nil {
+      m.Diff = sec.filter(m.Diff)
+    }
+  }
+  p.sendMessage(m)
 }
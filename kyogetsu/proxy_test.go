@@ -6,11 +6,16 @@
 package kyogetsu
 
 import (
+  "context"
+  "errors"
   "fmt"
+  "io/ioutil"
   "net/http"
   "net/http/httptest"
+  "os"
   "strings"
   "testing"
+  "time"
   )
 
 //A dummy MessageSender that checks the messages passed to it
@@ -24,6 +29,39 @@ func (d dummySender) SendMessage(m *Message) error{
   return nil
 }
 
+//A MessageSender that passes every message to a channel
+type chanSender chan *Message
+
+func (c chanSender) SendMessage(m *Message) error {
+  c <- m
+  return nil
+}
+
+//waitMessage waits for a message to arrive on c
+func waitMessage(t *testing.T, c chanSender) *Message {
+  select {
+  case m := <-c:
+    return m
+  case <-time.After(2 * time.Second):
+    t.Fatal("Timed out waiting for a message")
+  }
+  return nil
+}
+
+//Return a server that echos the request body after the prefix s
+func newEchoServer(s string) *httptest.Server {
+  handler := func(w http.ResponseWriter, r *http.Request) {
+    b, _ := ioutil.ReadAll(r.Body)
+    fmt.Fprintf(w, "%s:%s", s, b)
+  }
+  return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+//Get a MemoryCache so the proxy tests don't need Redis
+func getMemoryCache() *MemoryCache {
+  return NewMemoryCache(0, 0)
+}
+
 func newTestRequest() *http.Request {
   r, _ := http.NewRequest("POST", "", strings.NewReader("this is a test"))
   return r
@@ -55,9 +93,9 @@ func newProdServer(c...*http.Cookie) *httptest.Server {
   return newCookieServer("Prod", c)
 }
 
-func newTestKyogetsuProxy(p *httptest.Server, s *httptest.Server, ms MessageSender, c *RedisCache) KyogetsuProxy {
+func newTestKyogetsuProxy(p *httptest.Server, s *httptest.Server, ms MessageSender, c CookieCache) KyogetsuProxy {
   ph := NewSingleProxyHandler(p.URL, s.URL)
-  return NewKyogetsuProxy(ph, ms, *c, CookieIdFunction("id"))
+  return NewKyogetsuProxy(ph, ms, c, CookieIdFunction("id"))
 }
 
 func setBasicCookie(r *http.Request) {
@@ -177,15 +215,14 @@ func TestLoadCookies(t *testing.T) {
     ss := newStagingServer()
     defer ss.Close()
 
-    rc := getRedisCache()
+    rc := getMemoryCache()
     k := newTestKyogetsuProxy(ps, ss, dummySender{}, rc)
-    rc.pool.Cmd("FLUSHALL")
     err := k.ccache.SetCookie(test.Id, &http.Cookie{Name: test.Name, Value: test.Value})
     if err != nil {
       t.Errorf("Got Error: %s", err)
     }
 
-    k.loadCookies(test.Id, r)
+    k.loadCookies(test.Id, r.URL.Host, r)
     c := r.Cookies()
     if c[0].Name != test.Name {
       t.Errorf("Cookie Name Mismatch Expected: %s Got: %s", test.Name, c[0].Name)
@@ -215,9 +252,8 @@ func TestSaveCookies(t *testing.T) {
     ss := newStagingServer()
     defer ss.Close()
 
-    rc := getRedisCache()
+    rc := getMemoryCache()
     k := newTestKyogetsuProxy(ps, ss, dummySender{}, rc)
-    rc.pool.Cmd("FLUSHALL")
 
     k.saveCookies(test.Id, r)
     c, err := rc.GetCookies(test.Id)
@@ -284,11 +320,11 @@ func TestHandleStaging(t *testing.T) {
       nr.AddCookie(c)
     }
 
-    ms := dummySender{Message{NewRequestInfo(nr),
-                              NewRequestInfo(nr),
-                              ResponseInfo{200, http.Header{}, "Prod"},
-                              ResponseInfo{200, http.Header{}, "Staging"}}, t}
-    rc := getRedisCache()
+    ms := dummySender{Message{ProdRequest: NewRequestInfo(nr),
+                              StagingRequest: NewRequestInfo(nr),
+                              ProdReponse: ResponseInfo{200, http.Header{}, "Prod"},
+                              StagingReponse: ResponseInfo{200, http.Header{}, "Staging"}}, t}
+    rc := getMemoryCache()
     k := newTestKyogetsuProxy(ps, ss, ms, rc)
 
     pw := httptest.NewRecorder()
@@ -308,11 +344,11 @@ func TestServeHTTP(t *testing.T) {
   r, _ := http.NewRequest("Post", ps.URL + "/", strings.NewReader(""))
   nr, _ := http.NewRequest(r.Method, ss.URL + "/", r.Body)
 
-  ms := dummySender{Message{NewRequestInfo(nr),
-                            NewRequestInfo(nr),
-                            ResponseInfo{200, http.Header{}, "Prod"},
-                            ResponseInfo{200, http.Header{}, "Staging"}}, t}
-  rc := getRedisCache()
+  ms := dummySender{Message{ProdRequest: NewRequestInfo(nr),
+                            StagingRequest: NewRequestInfo(nr),
+                            ProdReponse: ResponseInfo{200, http.Header{}, "Prod"},
+                            StagingReponse: ResponseInfo{200, http.Header{}, "Staging"}}, t}
+  rc := getMemoryCache()
   k := newTestKyogetsuProxy(ps, ss, ms, rc)
 
   pw := httptest.NewRecorder()
@@ -322,3 +358,286 @@ func TestServeHTTP(t *testing.T) {
     t.Errorf("Expected: Prod Got: %s", pw.Body.String())
   }
 }
+
+func TestServeHTTPStreamsProduction(t *testing.T) {
+  ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.SetCookie(w, &http.Cookie{Name: "id", Value: "bob"})
+    fmt.Fprintf(w, "Prod")
+  }))
+  defer ps.Close()
+
+  ss := newStagingServer()
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  rc := getMemoryCache()
+  k := newTestKyogetsuProxy(ps, ss, ms, rc)
+  k.opts.MaxResponseCapture = 2
+
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  w := httptest.NewRecorder()
+  k.ServeHTTP(w, r)
+
+  if w.Body.String() != "Prod" {
+    t.Errorf("Expected: Prod Got: %s", w.Body.String())
+  }
+  c := (&http.Response{Header: w.Header()}).Cookies()
+  if len(c) != 1 || c[0].Value != "bob" {
+    t.Errorf("Production cookies were not passed to the client: %v", c)
+  }
+  m := waitMessage(t, ms)
+  if m.ProdReponse.Body != "Pr" {
+    t.Errorf("Expected the recorded body to be truncated to Pr Got: %s", m.ProdReponse.Body)
+  }
+}
+
+func TestServeHTTPMirrorsRequestBody(t *testing.T) {
+  tests := []struct {
+    Body string
+    Spill int64
+  } {
+    {"name=bob&amount=10", 1024},
+    {"a body large enough to be spilled to disk", 8},
+  }
+  for _, test := range tests {
+    ps := newEchoServer("Prod")
+    defer ps.Close()
+
+    ss := newEchoServer("Staging")
+    defer ss.Close()
+
+    ms := make(chanSender, 1)
+    rc := getMemoryCache()
+    k := newTestKyogetsuProxy(ps, ss, ms, rc)
+    k.opts.RequestSpillThreshold = test.Spill
+
+    r, _ := http.NewRequest("POST", ps.URL + "/", strings.NewReader(test.Body))
+    w := httptest.NewRecorder()
+    k.ServeHTTP(w, r)
+
+    if w.Body.String() != "Prod:" + test.Body {
+      t.Errorf("Expected: Prod:%s Got: %s", test.Body, w.Body.String())
+    }
+    m := waitMessage(t, ms)
+    if m.StagingReponse.Body != "Staging:" + test.Body {
+      t.Errorf("Expected: Staging:%s Got: %s", test.Body, m.StagingReponse.Body)
+    }
+    if m.ProdRequest.Body != test.Body {
+      t.Errorf("Prod Request Body Expected: %s Got: %s", test.Body, m.ProdRequest.Body)
+    }
+    if m.StagingRequest.Body != test.Body {
+      t.Errorf("Staging Request Body Expected: %s Got: %s", test.Body, m.StagingRequest.Body)
+    }
+  }
+}
+
+func TestServeHTTPSkipsOversizedBodies(t *testing.T) {
+  ps := newEchoServer("Prod")
+  defer ps.Close()
+
+  ss := newEchoServer("Staging")
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  rc := getMemoryCache()
+  k := newTestKyogetsuProxy(ps, ss, ms, rc)
+  k.opts.MaxRequestBody = 4
+
+  r, _ := http.NewRequest("POST", ps.URL + "/", strings.NewReader("too large"))
+  w := httptest.NewRecorder()
+  k.ServeHTTP(w, r)
+
+  if w.Body.String() != "Prod:too large" {
+    t.Errorf("Expected: Prod:too large Got: %s", w.Body.String())
+  }
+  select {
+  case <-ms:
+    t.Error("A request with an oversized body should not be mirrored")
+  case <-time.After(100 * time.Millisecond):
+  }
+}
+
+//A ResponseWriter whose client has gone away
+type abortedWriter struct {
+  *httptest.ResponseRecorder
+}
+
+func (w abortedWriter) Write(b []byte) (int, error) {
+  return 0, errors.New("client disconnected")
+}
+
+func TestServeHTTPClosesSnapshotOnAbort(t *testing.T) {
+  ps := newEchoServer("Prod")
+  defer ps.Close()
+
+  ss := newEchoServer("Staging")
+  defer ss.Close()
+
+  dir, _ := ioutil.TempDir("", "kyogetsu-test-")
+  defer os.RemoveAll(dir)
+
+  ms := make(chanSender, 1)
+  k := newTestKyogetsuProxy(ps, ss, ms, getMemoryCache())
+  k.opts.RequestSpillThreshold = 8
+  k.opts.TempDir = dir
+
+  //the ReverseProxy only panics when it runs under an http.Server
+  r, _ := http.NewRequest("POST", ps.URL + "/", strings.NewReader("a body large enough to be spilled to disk"))
+  r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+  func() {
+    defer func() {
+      if v := recover(); v != http.ErrAbortHandler {
+        t.Errorf("Expected the handler to abort Got: %v", v)
+      }
+    }()
+    k.ServeHTTP(abortedWriter{httptest.NewRecorder()}, r)
+  }()
+
+  files, _ := ioutil.ReadDir(dir)
+  if len(files) != 0 {
+    t.Errorf("Expected the spilled body to be removed Got: %d files", len(files))
+  }
+}
+
+//Return a server that waits for d before responding
+func newSlowServer(s string, d time.Duration) *httptest.Server {
+  handler := func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-time.After(d):
+    case <-r.Context().Done():
+      return
+    }
+    fmt.Fprintf(w, s)
+  }
+  return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+func TestHandleStagingTimeout(t *testing.T) {
+  tests := []struct {
+    Path string
+    Outcome string
+    Status int
+  } {
+    {"/slow", OutcomeTimeout, 0},
+    {"/patient", OutcomeOK, 200},
+  }
+  for _, test := range tests {
+    ps := newProdServer()
+    defer ps.Close()
+
+    ss := newSlowServer("Staging", 100 * time.Millisecond)
+    defer ss.Close()
+
+    ms := make(chanSender, 1)
+    ph := NewSingleProxyHandler(ps.URL, ss.URL)
+    k := NewKyogetsuProxyWithOptions(ph, ms, getMemoryCache(), CookieIdFunction("id"), Options{
+      StagingTimeout: 20 * time.Millisecond,
+      RouteTimeouts: []RouteTimeout{{MatchPathPrefix("/patient"), time.Second}},
+    })
+
+    //the client going away must not cancel staging
+    ctx, cancel := context.WithCancel(context.Background())
+    r, _ := http.NewRequestWithContext(ctx, "GET", ps.URL + test.Path, nil)
+    cancel()
+    k.HandleStaging(r, httptest.NewRecorder())
+
+    m := waitMessage(t, ms)
+    if m.Outcome != test.Outcome {
+      t.Errorf("%s: Outcome Expected: %s Got: %s", test.Path, test.Outcome, m.Outcome)
+    }
+    if m.StagingReponse.Status != test.Status {
+      t.Errorf("%s: Status Expected: %d Got: %d", test.Path, test.Status, m.StagingReponse.Status)
+    }
+  }
+}
+
+//A MessageSender and CookieCache that records being flushed
+//and closed
+type closingSender struct {
+  chanSender
+  *MemoryCache
+  flushed int
+  closed int
+}
+
+func (c *closingSender) Flush() error {
+  c.flushed++
+  return nil
+}
+
+func (c *closingSender) Close() error {
+  c.closed++
+  return nil
+}
+
+func TestShutdown(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+
+  ss := newSlowServer("Staging", 50 * time.Millisecond)
+  defer ss.Close()
+
+  cs := &closingSender{chanSender: make(chanSender, 2), MemoryCache: getMemoryCache()}
+  ph := NewSingleProxyHandler(ps.URL, ss.URL)
+  k := NewKyogetsuProxyWithOptions(ph, cs, cs, CookieIdFunction("id"), Options{})
+
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+
+  if err := k.Shutdown(context.Background()); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if len(cs.chanSender) != 1 {
+    t.Error("In flight staging work was not finished before Shutdown returned")
+  }
+  if cs.flushed != 1 || cs.closed != 1 {
+    t.Errorf("Expected the shared MessageSender and CookieCache to be flushed and closed once Got: %d %d",
+             cs.flushed, cs.closed)
+  }
+
+  //production is still served but nothing more is mirrored
+  w := httptest.NewRecorder()
+  k.ServeHTTP(w, r)
+  if w.Body.String() != "Prod" {
+    t.Errorf("Expected: Prod Got: %s", w.Body.String())
+  }
+  time.Sleep(100 * time.Millisecond)
+  if len(cs.chanSender) != 1 {
+    t.Error("A request was mirrored after Shutdown")
+  }
+}
+
+func TestShutdownTimeout(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+
+  ss := newSlowServer("Staging", 200 * time.Millisecond)
+  defer ss.Close()
+
+  cs := &closingSender{chanSender: make(chanSender, 2), MemoryCache: getMemoryCache()}
+  ph := NewSingleProxyHandler(ps.URL, ss.URL)
+  k := NewKyogetsuProxyWithOptions(ph, cs, cs, CookieIdFunction("id"), Options{})
+
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  if err := k.Shutdown(ctx); err != context.DeadlineExceeded {
+    t.Errorf("Expected: %s Got: %v", context.DeadlineExceeded, err)
+  }
+  if cs.flushed != 0 || cs.closed != 0 {
+    t.Errorf("Expected nothing to be closed under running staging work Got: %d %d", cs.flushed, cs.closed)
+  }
+
+  //a second Shutdown waits for the work and closes everything
+  if err := k.Shutdown(context.Background()); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if len(cs.chanSender) != 1 {
+    t.Error("The staging work was not finished")
+  }
+  if cs.flushed != 1 || cs.closed != 1 {
+    t.Errorf("Expected one flush and close Got: %d %d", cs.flushed, cs.closed)
+  }
+}
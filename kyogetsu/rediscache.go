@@ -6,27 +6,169 @@
 package kyogetsu
 
 import (
-  "github.com/mediocregopher/radix.v2/pool"
+  "errors"
+  "github.com/mediocregopher/radix.v2/redis"
+  "github.com/mediocregopher/radix.v2/util"
   "net/http"
+  "strconv"
+  "time"
 )
 
+//sessionExpiresField is the hash field holding the absolute
+//deadline of a session in milliseconds.  It can never clash
+//with a cookie since ':' is not allowed in cookie names
+const sessionExpiresField = "kyogetsu:expires"
+
+//touchScript sets the absolute deadline of a session the first
+//time it is seen and then expires the hash after the idle TTL,
+//or at the deadline if that comes first.
+//KEYS[1] is the hash, ARGV is the deadline field, the current
+//time, the absolute TTL and the idle TTL, all in milliseconds
+const touchScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+local now = tonumber(ARGV[2])
+local absolute = tonumber(ARGV[3])
+local idle = tonumber(ARGV[4])
+local deadline = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if deadline == 0 and absolute > 0 then
+  deadline = now + absolute
+  redis.call('HSET', KEYS[1], ARGV[1], deadline)
+end
+local ttl = 0
+if deadline > 0 then
+  ttl = deadline - now
+  if ttl <= 0 then
+    redis.call('DEL', KEYS[1])
+    return 0
+  end
+end
+if idle > 0 and (ttl == 0 or idle < ttl) then
+  ttl = idle
+end
+if ttl > 0 then
+  redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`
+
+//changeIdScript merges the hash of the old id into the hash of
+//the new id, resolving cookies stored under both with the
+//conflict policy, then expires the old hash after the grace
+//period or deletes it.  The new hash keeps its own deadline if
+//it has one.  It returns 0 if the old hash does not exist and
+//-1 on a conflict with the fail policy, without writing.
+//KEYS[1] is the old hash and KEYS[2] the new hash, ARGV is the
+//deadline field, the IdConflictPolicy, the grace period and
+//the current time, both in milliseconds.
+//With four keys the staging session link of the old id,
+//KEYS[3], also moves to the new id, KEYS[4], unless it has one.
+//ARGV[5] is then the prefix of the staging link keys and
+//ARGV[6] the new id
+const changeIdScript = `
+local function movelink()
+  if #KEYS < 4 or redis.call('EXISTS', KEYS[4]) == 1 then
+    return
+  end
+  local sid = redis.call('GET', KEYS[3])
+  if not sid then
+    return
+  end
+  local ttl = redis.call('PTTL', KEYS[3])
+  redis.call('DEL', KEYS[3])
+  for _, kv in ipairs({{KEYS[4], sid}, {ARGV[5] .. sid, ARGV[6]}}) do
+    if ttl > 0 then
+      redis.call('SET', kv[1], kv[2], 'PX', ttl)
+    else
+      redis.call('SET', kv[1], kv[2])
+    end
+  end
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  movelink()
+  return 0
+end
+local old = redis.call('HGETALL', KEYS[1])
+local policy = tonumber(ARGV[2])
+if policy == 2 then
+  for i = 1, #old, 2 do
+    if old[i] ~= ARGV[1] and redis.call('HEXISTS', KEYS[2], old[i]) == 1 then
+      return -1
+    end
+  end
+end
+for i = 1, #old, 2 do
+  if policy == 0 and old[i] ~= ARGV[1] then
+    redis.call('HSET', KEYS[2], old[i], old[i + 1])
+  else
+    redis.call('HSETNX', KEYS[2], old[i], old[i + 1])
+  end
+end
+movelink()
+local grace = tonumber(ARGV[3])
+if grace <= 0 then
+  redis.call('DEL', KEYS[1])
+  return 1
+end
+local deadline = tonumber(ARGV[4]) + grace
+local current = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if current == 0 or deadline < current then
+  redis.call('HSET', KEYS[1], ARGV[1], deadline)
+end
+redis.call('PEXPIRE', KEYS[1], grace)
+return 1
+`
+
 //A CookieCache that uses Redis as it's backend store.
 //It stores the cookie data in a Redis HashMap under
-//the key <namespace>.<id>
+//the key <namespace>.<id>, with one field per cookie name
+//holding the cookie and all of its attributes
 type RedisCache struct {
-  pool *pool.Pool
+  client util.Cmder
+  close func()
+  cluster bool
   namespace string
+  absoluteTTL time.Duration
+  idleTTL time.Duration
+  conflict IdConflictPolicy
+  oldIdGrace time.Duration
+}
+
+//SetSessionTTL makes sessions expire.  A session is removed
+//absolute after it was first stored, or once it has not been
+//read or written for idle, whichever comes first.  A TTL of
+//zero is not applied.  Sessions get their deadline the next
+//time they are touched
+func (r *RedisCache) SetSessionTTL(absolute time.Duration, idle time.Duration) {
+  r.absoluteTTL = absolute
+  r.idleTTL = idle
+}
+
+//SetChangeIdPolicy sets how ChangeCookiesId merges the cookies
+//of the old id into those of the new id, and how long the old
+//id keeps working afterwards so staging requests already in
+//flight with it still find their cookies.  A grace of zero
+//deletes the old id at once.  The default is OldIdWins with
+//DefaultOldIdGrace
+func (r *RedisCache) SetChangeIdPolicy(conflict IdConflictPolicy, grace time.Duration) {
+  r.conflict = conflict
+  r.oldIdGrace = grace
 }
 
-//SetCookie extracts the name and value from an
-//*http.Cookie and stores in the id's hash map
+//SetCookie serializes an *http.Cookie and stores it
+//in the id's hash map
 func (r RedisCache) SetCookie(id string, c *http.Cookie) error {
   k := r.namespacedId(id)
-  return r.pool.Cmd("HSET", k, c.Name, c.Value).Err
+  err := r.client.Cmd("HSET", k, c.Name, encodeCookie(c, time.Now())).Err
+  if err != nil {
+    return err
+  }
+  return r.touch(k)
 }
 
-//SetCookies stores the name and value data for
-//an array of *http.Cookies in the id's hash map
+//SetCookies serializes an array of *http.Cookies and
+//stores them in the id's hash map
 func (r RedisCache) SetCookies(id string, c []*http.Cookie) error {
   //Incase there are no cookies to add, just return
   if len(c) == 0 {
@@ -34,46 +176,362 @@ func (r RedisCache) SetCookies(id string, c []*http.Cookie) error {
   }
 
   k := r.namespacedId(id)
+  now := time.Now()
   m := map[string]string{}
   for _, v := range c {
-    m[v.Name] = v.Value
+    m[v.Name] = encodeCookie(v, now)
   }
 
-  return r.pool.Cmd("HMSET", k, m).Err
+  err := r.client.Cmd("HMSET", k, m).Err
+  if err != nil {
+    return err
+  }
+  return r.touch(k)
 }
 
 //GetCookie gets a cookie stored in Redis
 func (r RedisCache) GetCookie(id string, key string) (*http.Cookie, error) {
   k := r.namespacedId(id)
-  v, err := r.pool.Cmd("HGET", k, key).Str()
+  v, err := r.client.Cmd("HGET", k, key).Str()
   if err != nil {
     return nil, err
   }
-  return &http.Cookie{Name: key, Value: v}, nil
+  if err = r.touch(k); err != nil {
+    return nil, err
+  }
+  return decodeCookie(key, v), nil
 }
 
 //GetCookies gets all cookies stored in Redis for
 //a given Id
 func (r RedisCache) GetCookies(id string) ([]*http.Cookie, error) {
   k := r.namespacedId(id)
-  m, err := r.pool.Cmd("HGETALL", k).Map()
+  m, err := r.client.Cmd("HGETALL", k).Map()
   if err != nil {
     return nil, err
   }
+  if err = r.touch(k); err != nil {
+    return nil, err
+  }
   c := make([]*http.Cookie, 0, len(m))
   for k, v := range m {
-    c = append(c, &http.Cookie{Name: k, Value: v})
+    if k == sessionExpiresField {
+      continue
+    }
+    c = append(c, decodeCookie(k, v))
   }
   return c, nil
 }
 
-//ChangeCookiesId uses the rename command to change the
-//id that the cookie data is returned under
+//MigrateCookies rewrites every cookie stored by older versions,
+//which only kept the cookie's value, in the current format.
+//Old values are read correctly without it, but migrating
+//lets other tools read the hashes.  It returns the number
+//of cookies that were rewritten.  It is not supported with
+//Redis Cluster, where SCAN only sees a single node
+func (r RedisCache) MigrateCookies() (int, error) {
+  if r.cluster {
+    return 0, errors.New("MigrateCookies is not supported with Redis Cluster")
+  }
+  n := 0
+  cursor := "0"
+  for {
+    a, err := r.client.Cmd("SCAN", cursor, "MATCH", r.namespace + ".*", "COUNT", 100).Array()
+    if err != nil {
+      return n, err
+    }
+    if len(a) != 2 {
+      return n, errors.New("unexpected reply to SCAN")
+    }
+    if cursor, err = a[0].Str(); err != nil {
+      return n, err
+    }
+    keys, err := a[1].List()
+    if err != nil {
+      return n, err
+    }
+    for _, k := range keys {
+      m, err := r.client.Cmd("HGETALL", k).Map()
+      if err != nil {
+        //not a cookie hash
+        continue
+      }
+      for name, v := range m {
+        if name == sessionExpiresField || !isLegacyCookie(v) {
+          continue
+        }
+        c := &http.Cookie{Name: name, Value: v}
+        if err := r.client.Cmd("HSET", k, name, encodeCookie(c, time.Now())).Err; err != nil {
+          return n, err
+        }
+        n++
+      }
+    }
+    if cursor == "0" {
+      return n, nil
+    }
+  }
+}
+
+//DeleteCookie removes a cookie from the id's hash map
+func (r RedisCache) DeleteCookie(id string, key string) error {
+  return r.DeleteCookies(id, []string{key})
+}
+
+//DeleteCookies removes the named cookies from the id's
+//hash map
+func (r RedisCache) DeleteCookies(id string, keys []string) error {
+  if len(keys) == 0 {
+    return nil
+  }
+  k := r.namespacedId(id)
+  return r.client.Cmd("HDEL", k, keys).Err
+}
+
+//ChangeCookiesId merges the cookies of old_id into new_id in a
+//single atomic script, following the IdConflictPolicy.  Nothing
+//happens if old_id has no cookies.  The old id is kept for the
+//grace period set by SetChangeIdPolicy.  A session's deadline
+//and staging session link move with it unless new_id already
+//has them.  With Redis Cluster the two ids are usually on
+//different nodes, so the merge is done with separate commands
+//and is not atomic
 func (r RedisCache) ChangeCookiesId(old_id string, new_id string) error {
-  old_id = r.namespacedId(old_id)
-  new_id = r.namespacedId(new_id)
+  if old_id == new_id {
+    return nil
+  }
+  return r.changeId(r.namespacedId(old_id), r.namespacedId(new_id), old_id, new_id)
+}
+
+//SetState stores session state values in the id's state hash.
+//RedisCache keeps state under <namespace>:state.<id>, apart
+//from the cookies, with the same session TTLs
+func (r RedisCache) SetState(id string, values map[string]string) error {
+  if len(values) == 0 {
+    return nil
+  }
+  k := r.stateId(id)
+  if err := r.client.Cmd("HMSET", k, values).Err; err != nil {
+    return err
+  }
+  return r.touch(k)
+}
+
+//GetState gets every session state value stored for the id
+func (r RedisCache) GetState(id string) (map[string]string, error) {
+  k := r.stateId(id)
+  m, err := r.client.Cmd("HGETALL", k).Map()
+  if err != nil {
+    return nil, err
+  }
+  if err = r.touch(k); err != nil {
+    return nil, err
+  }
+  delete(m, sessionExpiresField)
+  return m, nil
+}
+
+//ChangeStateId merges the session state of old_id into new_id
+//the same way ChangeCookiesId merges cookies
+func (r RedisCache) ChangeStateId(old_id string, new_id string) error {
+  if old_id == new_id {
+    return nil
+  }
+  return r.changeId(r.stateId(old_id), r.stateId(new_id), "", "")
+}
+
+//MapSessionIds links the session prodId to the staging session
+//stagingId.  The links are kept under <namespace>:prod.<id> and
+//<namespace>:staging.<id> and expire after the idle TTL, or
+//the absolute TTL if there is no idle TTL.  The commands are
+//not atomic, the session ordering of the proxy keeps two
+//requests of a session from linking it at the same time
+func (r RedisCache) MapSessionIds(prodId string, stagingId string) error {
+  pk := r.namespace + ":prod." + prodId
+  sk := r.namespace + ":staging." + stagingId
+  ttl := r.idleTTL
+  if ttl <= 0 {
+    ttl = r.absoluteTTL
+  }
+
+  //drop the links replaced by this one
+  if old, err := r.client.Cmd("GET", pk).Str(); err == nil && old != stagingId {
+    r.unlink(r.namespace + ":staging." + old, prodId)
+  }
+  if old, err := r.client.Cmd("GET", sk).Str(); err == nil && old != prodId {
+    r.unlink(r.namespace + ":prod." + old, stagingId)
+  }
 
-  return r.pool.Cmd("RENAME", old_id, new_id).Err
+  for _, kv := range [][2]string{{pk, stagingId}, {sk, prodId}} {
+    var err error
+    if ttl > 0 {
+      err = r.client.Cmd("SET", kv[0], kv[1], "PX", int64(ttl / time.Millisecond)).Err
+    } else {
+      err = r.client.Cmd("SET", kv[0], kv[1]).Err
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+//unlink deletes the link k if it still points to id
+func (r RedisCache) unlink(k string, id string) {
+  if v, err := r.client.Cmd("GET", k).Str(); err == nil && v == id {
+    r.client.Cmd("DEL", k)
+  }
+}
+
+//StagingSessionId returns the staging session id linked to
+//prodId
+func (r RedisCache) StagingSessionId(prodId string) (string, error) {
+  return r.linkedId(r.namespace + ":prod." + prodId)
+}
+
+//ProdSessionId returns the session id linked to stagingId
+func (r RedisCache) ProdSessionId(stagingId string) (string, error) {
+  return r.linkedId(r.namespace + ":staging." + stagingId)
+}
+
+func (r RedisCache) linkedId(k string) (string, error) {
+  resp := r.client.Cmd("GET", k)
+  if resp.Err != nil {
+    return "", resp.Err
+  }
+  if resp.IsType(redis.Nil) {
+    return "", ErrNoId
+  }
+  return resp.Str()
+}
+
+//changeId merges the hash old into the hash new.  If prodId
+//is set its staging session link moves to newProdId
+func (r RedisCache) changeId(old string, new string, prodId string, newProdId string) error {
+  now := time.Now().UnixNano() / int64(time.Millisecond)
+  grace := int64(r.oldIdGrace / time.Millisecond)
+  var n int
+  var err error
+  switch {
+  case r.cluster:
+    n, err = r.mergeIds(old, new, grace, now)
+    if err == nil && n != -1 && prodId != "" {
+      err = r.moveLink(prodId, newProdId)
+    }
+  case prodId != "":
+    n, err = util.LuaEval(r.client, changeIdScript, 4, old, new,
+                          r.namespace + ":prod." + prodId, r.namespace + ":prod." + newProdId,
+                          sessionExpiresField, int(r.conflict), grace, now,
+                          r.namespace + ":staging.", newProdId).Int()
+  default:
+    n, err = util.LuaEval(r.client, changeIdScript, 2, old, new, sessionExpiresField,
+                          int(r.conflict), grace, now).Int()
+  }
+  if err != nil {
+    return err
+  }
+  switch n {
+  case 0:
+    return nil
+  case -1:
+    return ErrIdConflict
+  }
+  return r.touch(new)
+}
+
+//mergeIds does what changeIdScript does with one command at a
+//time, for Redis Cluster where a script can not use keys
+//stored on different nodes
+func (r RedisCache) mergeIds(old_id string, new_id string, grace int64, now int64) (int, error) {
+  old, err := r.client.Cmd("HGETALL", old_id).Map()
+  if err != nil {
+    return 0, err
+  }
+  if len(old) == 0 {
+    return 0, nil
+  }
+  cur, err := r.client.Cmd("HGETALL", new_id).Map()
+  if err != nil {
+    return 0, err
+  }
+  m := map[string]string{}
+  for k, v := range old {
+    _, exists := cur[k]
+    switch {
+    case !exists:
+    case r.conflict == FailOnConflict && k != sessionExpiresField:
+      return -1, nil
+    case r.conflict == NewIdWins || k == sessionExpiresField:
+      continue
+    }
+    m[k] = v
+  }
+  if len(m) > 0 {
+    if err = r.client.Cmd("HMSET", new_id, m).Err; err != nil {
+      return 0, err
+    }
+  }
+
+  if grace <= 0 {
+    return 1, r.client.Cmd("DEL", old_id).Err
+  }
+  deadline := now + grace
+  if d, _ := strconv.ParseInt(old[sessionExpiresField], 10, 64); d == 0 || deadline < d {
+    if err = r.client.Cmd("HSET", old_id, sessionExpiresField, deadline).Err; err != nil {
+      return 0, err
+    }
+  }
+  return 1, r.client.Cmd("PEXPIRE", old_id, grace).Err
+}
+
+//moveLink moves the staging session link of prodId to
+//newProdId unless it has one, like changeIdScript does
+func (r RedisCache) moveLink(prodId string, newProdId string) error {
+  pk := r.namespace + ":prod." + prodId
+  nk := r.namespace + ":prod." + newProdId
+  if n, err := r.client.Cmd("EXISTS", nk).Int(); err != nil || n == 1 {
+    return err
+  }
+  resp := r.client.Cmd("GET", pk)
+  if resp.IsType(redis.Nil) {
+    return nil
+  }
+  sid, err := resp.Str()
+  if err != nil {
+    return err
+  }
+  ttl, err := r.client.Cmd("PTTL", pk).Int64()
+  if err != nil {
+    return err
+  }
+  for _, kv := range [][2]string{{nk, sid}, {r.namespace + ":staging." + sid, newProdId}} {
+    if ttl > 0 {
+      err = r.client.Cmd("SET", kv[0], kv[1], "PX", ttl).Err
+    } else {
+      err = r.client.Cmd("SET", kv[0], kv[1]).Err
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return r.client.Cmd("DEL", pk).Err
+}
+
+//touch applies the session TTLs to the hash map k
+func (r RedisCache) touch(k string) error {
+  if r.absoluteTTL <= 0 && r.idleTTL <= 0 {
+    return nil
+  }
+  now := time.Now().UnixNano() / int64(time.Millisecond)
+  return util.LuaEval(r.client, touchScript, 1, k, sessionExpiresField, now,
+                      int64(r.absoluteTTL / time.Millisecond),
+                      int64(r.idleTTL / time.Millisecond)).Err
+}
+
+//Close closes all the connections to Redis
+func (r RedisCache) Close() error {
+  r.close()
+  return nil
 }
 
 func (r RedisCache) namespacedId(id string) string {
@@ -81,14 +539,19 @@ func (r RedisCache) namespacedId(id string) string {
   return k
 }
 
+func (r RedisCache) stateId(id string) string {
+  return r.namespace + ":state." + id
+}
+
 // Creates a new RedisCache with only a single connection.
 // If more connections are needed they will be created on
 // the fly.  This is still a redis pool
-func NewRedisCache(addr string) *RedisCache {
+func NewRedisCache(addr string) (*RedisCache, error) {
   return NewRedisCachePool(addr, 1)
 }
 
-func NewRedisCachePool(addr string, size int) *RedisCache {
-  p, _ := pool.New("tcp", addr, size)
-  return &RedisCache{pool: p, namespace: "kyogetsu"}
+//NewRedisCachePool creates a new RedisCache keeping size
+//connections to the Redis server at addr
+func NewRedisCachePool(addr string, size int) (*RedisCache, error) {
+  return NewRedisCacheOptions(RedisOptions{Addr: addr, PoolSize: size})
 }
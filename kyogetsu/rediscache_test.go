@@ -6,9 +6,10 @@
 package kyogetsu
 
 import (
-  "github.com/mediocregopher/radix.v2/pool"
+  "github.com/mediocregopher/radix.v2/util"
   "testing"
   "net/http"
+  "time"
   )
 
 type cookieData struct {
@@ -17,22 +18,26 @@ type cookieData struct {
 }
 
 //get a redis connection
-func getRedisConn(rc *RedisCache) *pool.Pool {
-  e := rc.pool.Cmd("FLUSHALL").Err
+func getRedisConn(rc *RedisCache) util.Cmder {
+  e := rc.client.Cmd("FLUSHALL").Err
   if e != nil {
     panic(e)
   }
-  return rc.pool
+  return rc.client
 }
 
 //Get a RedisCache, provides a single place to change
 //the host address
 func getRedisCache() *RedisCache {
-  return NewRedisCache("127.0.0.1:6379")
+  rc, err := NewRedisCache("127.0.0.1:6379")
+  if err != nil {
+    panic(err)
+  }
+  return rc
 }
 
 //Close and clean up the redis connection
-func closeRedisConn(r *pool.Pool) {
+func closeRedisConn(r util.Cmder) {
   e := r.Cmd("FLUSHALL").Err
   if e != nil {
     panic(e)
@@ -72,8 +77,8 @@ func TestSetCookie(t *testing.T) {
       return
     }
 
-    if test.cd.Value != v {
-      t.Errorf("Expected: %s, Got: %s", test.cd.Value, v)
+    if c := decodeCookie(test.cd.Name, v); test.cd.Value != c.Value {
+      t.Errorf("Expected: %s, Got: %s", test.cd.Value, c.Value)
     }
   }
 }
@@ -119,8 +124,8 @@ func TestSetCookies(t *testing.T) {
     }
 
     for _, v := range test.cd  {
-      if m[v.Name] != v.Value {
-        t.Errorf("Expected: %s Got: %s", v.Value, m[v.Name])
+      if c := decodeCookie(v.Name, m[v.Name]); c.Value != v.Value {
+        t.Errorf("Expected: %s Got: %s", v.Value, c.Value)
       }
     }
   }
@@ -261,3 +266,236 @@ func TestChangeCookiesId(t *testing.T) {
     }
   }
 }
+
+func TestGetCookiesKeepsAttributes(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+
+  exp := time.Now().Add(time.Hour).Truncate(time.Second)
+  in := &http.Cookie{Name: "session", Value: "abc", Path: "/app", Domain: "example.com",
+                     Expires: exp, Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+  if err := rc.SetCookie("bill", in); err != nil {
+    t.Errorf("Got Error: %s", err)
+    return
+  }
+
+  c, err := rc.GetCookies("bill")
+  if err != nil || len(c) != 1 {
+    t.Errorf("Expected one cookie Got: %v %v", c, err)
+    return
+  }
+  if c[0].Path != in.Path || c[0].Domain != in.Domain || !c[0].Expires.Equal(exp) ||
+     !c[0].Secure || !c[0].HttpOnly || c[0].SameSite != in.SameSite {
+    t.Errorf("Expected: %v Got: %v", in, c[0])
+  }
+}
+
+func TestMigrateCookies(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+
+  r.Cmd("HSET", getIdPath("bill"), "type", "legacy")
+  rc.SetCookie("bill", &http.Cookie{Name: "new", Value: "format"})
+
+  n, err := rc.MigrateCookies()
+  if err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  if n != 1 {
+    t.Errorf("Expected: 1 cookie migrated Got: %d", n)
+  }
+  v, _ := r.Cmd("HGET", getIdPath("bill"), "type").Str()
+  if isLegacyCookie(v) || decodeCookie("type", v).Value != "legacy" {
+    t.Errorf("Cookie was not migrated: %s", v)
+  }
+}
+
+func TestDeleteCookies(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+
+  rc.SetCookies("bill", []*http.Cookie{
+    &http.Cookie{Name: "a", Value: "1"},
+    &http.Cookie{Name: "b", Value: "2"},
+    &http.Cookie{Name: "c", Value: "3"},
+  })
+  if err := rc.DeleteCookie("bill", "a"); err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  if err := rc.DeleteCookies("bill", []string{"b", "missing"}); err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  if err := rc.DeleteCookies("bill", nil); err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+
+  c, _ := rc.GetCookies("bill")
+  if len(c) != 1 || c[0].Name != "c" {
+    t.Errorf("Expected: [c=3] Got: %v", c)
+  }
+}
+
+func TestSessionTTL(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+  rc.SetSessionTTL(time.Hour, time.Minute)
+
+  rc.SetCookie("bill", &http.Cookie{Name: "a", Value: "1"})
+  ttl, err := r.Cmd("PTTL", getIdPath("bill")).Int64()
+  if err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  if ttl <= 0 || ttl > int64(time.Minute / time.Millisecond) {
+    t.Errorf("Expected the idle TTL to be applied Got: %dms", ttl)
+  }
+
+  c, _ := rc.GetCookies("bill")
+  if len(c) != 1 {
+    t.Errorf("The session deadline should not be returned as a cookie: %v", c)
+  }
+
+  rc.ChangeCookiesId("bill", "bob")
+  ttl, _ = r.Cmd("PTTL", getIdPath("bob")).Int64()
+  if ttl <= 0 {
+    t.Errorf("The TTL was not carried over to the new id Got: %dms", ttl)
+  }
+}
+
+func TestSessionTTLAbsoluteDeadline(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+  rc.SetSessionTTL(time.Minute, time.Hour)
+
+  rc.SetCookie("bill", &http.Cookie{Name: "a", Value: "1"})
+  ttl, _ := r.Cmd("PTTL", getIdPath("bill")).Int64()
+  if ttl <= 0 || ttl > int64(time.Minute / time.Millisecond) {
+    t.Errorf("Expected the absolute TTL to cap the idle TTL Got: %dms", ttl)
+  }
+
+  //a session past its deadline is removed when touched
+  r.Cmd("HSET", getIdPath("bill"), sessionExpiresField, 1)
+  rc.GetCookies("bill")
+  if n, _ := r.Cmd("EXISTS", getIdPath("bill")).Int(); n != 0 {
+    t.Error("Expected the expired session to be removed")
+  }
+}
+
+func TestChangeCookiesIdMerge(t *testing.T) {
+  var tests = []struct {
+    Policy IdConflictPolicy
+    Err error
+    Shared string
+  }{
+    {OldIdWins, nil, "old"},
+    {NewIdWins, nil, "new"},
+    {FailOnConflict, ErrIdConflict, "new"},
+  }
+  for _, test := range tests {
+    rc := getRedisCache()
+    r := getRedisConn(rc)
+    rc.SetChangeIdPolicy(test.Policy, 0)
+
+    rc.SetCookies("bill", []*http.Cookie{
+      &http.Cookie{Name: "shared", Value: "old"},
+      &http.Cookie{Name: "oldonly", Value: "1"},
+    })
+    rc.SetCookies("bob", []*http.Cookie{
+      &http.Cookie{Name: "shared", Value: "new"},
+      &http.Cookie{Name: "newonly", Value: "2"},
+    })
+
+    err := rc.ChangeCookiesId("bill", "bob")
+    if err != test.Err {
+      t.Errorf("Policy %d Expected: %v Got: %v", test.Policy, test.Err, err)
+    }
+    c, _ := rc.GetCookie("bob", "shared")
+    if c == nil || c.Value != test.Shared {
+      t.Errorf("Policy %d Expected: %s Got: %v", test.Policy, test.Shared, c)
+    }
+    if _, err := rc.GetCookie("bob", "newonly"); err != nil {
+      t.Errorf("Policy %d lost the new id's own cookie", test.Policy)
+    }
+    _, err = rc.GetCookie("bob", "oldonly")
+    if (test.Err == nil) != (err == nil) {
+      t.Errorf("Policy %d moved the old id's cookie: %v", test.Policy, err == nil)
+    }
+    closeRedisConn(r)
+  }
+}
+
+func TestChangeCookiesIdMissingOldId(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+
+  if err := rc.ChangeCookiesId("nobody", "bob"); err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  if n, _ := r.Cmd("EXISTS", getIdPath("bob")).Int(); n != 0 {
+    t.Error("A session was created for the new id")
+  }
+}
+
+func TestChangeCookiesIdGrace(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+  rc.SetChangeIdPolicy(OldIdWins, time.Minute)
+  rc.SetSessionTTL(0, time.Hour)
+
+  rc.SetCookie("bill", &http.Cookie{Name: "a", Value: "1"})
+  if err := rc.ChangeCookiesId("bill", "bob"); err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  if c, err := rc.GetCookie("bill", "a"); err != nil || c.Value != "1" {
+    t.Errorf("The old id should work during the grace period: %v %v", c, err)
+  }
+  //reading the old id must not extend it past the grace period
+  ttl, _ := r.Cmd("PTTL", getIdPath("bill")).Int64()
+  if ttl <= 0 || ttl > int64(time.Minute / time.Millisecond) {
+    t.Errorf("Expected the grace TTL on the old id Got: %dms", ttl)
+  }
+  if c, err := rc.GetCookie("bob", "a"); err != nil || c.Value != "1" {
+    t.Errorf("The cookie was not copied to the new id: %v %v", c, err)
+  }
+}
+
+func TestRedisCacheState(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+
+  rc.SetCookie("bill", &http.Cookie{Name: "token", Value: "cookie"})
+  if err := rc.SetState("bill", map[string]string{"token": "state"}); err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  s, err := rc.GetState("bill")
+  if err != nil || len(s) != 1 || s["token"] != "state" {
+    t.Errorf("Expected: map[token:state] Got: %v %v", s, err)
+  }
+  if c, _ := rc.GetCookie("bill", "token"); c == nil || c.Value != "cookie" {
+    t.Errorf("The state overwrote a cookie: %v", c)
+  }
+
+  if err = rc.ChangeStateId("bill", "bob"); err != nil {
+    t.Errorf("Got Error: %s", err)
+  }
+  if s, _ = rc.GetState("bob"); s["token"] != "state" {
+    t.Errorf("The state was not moved: %v", s)
+  }
+  if c, _ := rc.GetCookie("bill", "token"); c == nil {
+    t.Error("Changing the state id moved the cookies")
+  }
+}
+
+func TestRedisCacheSessionIds(t *testing.T) {
+  rc := getRedisCache()
+  r := getRedisConn(rc)
+  defer closeRedisConn(r)
+  testSessionIdMap(t, "redis", rc, rc)
+}
@@ -0,0 +1,338 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "github.com/mediocregopher/radix.v2/cluster"
+  "github.com/mediocregopher/radix.v2/pool"
+  "github.com/mediocregopher/radix.v2/redis"
+  "net"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//DefaultRedisNamespace is the prefix of the keys written by a
+//RedisCache when RedisOptions.Namespace is not set
+const DefaultRedisNamespace = "kyogetsu"
+
+//DefaultRedisPoolSize is the number of connections kept open
+//when RedisOptions.PoolSize is not set
+const DefaultRedisPoolSize = 10
+
+//RedisOptions describes how a RedisCache connects to Redis.
+//Any field left at its zero value uses the default
+type RedisOptions struct {
+  //Addr is the host:port of the Redis server.  With Sentinel
+  //it is a sentinel, with Cluster any node of the cluster
+  Addr string
+  //Username and Password are sent with AUTH when a connection
+  //is opened.  Username is only needed with Redis 6 ACLs
+  Username string
+  Password string
+  //DB is the database selected on every connection.  It must
+  //be 0 in Cluster mode
+  DB int
+  //TLS enables TLS on the connections to Redis when it is set
+  TLS *tls.Config
+  //Sentinel is the name of the master to ask the sentinel at
+  //Addr for.  Sentinel is not used if it is empty.  The
+  //sentinel is reached with the same TLS, AUTH and Timeout as
+  //the master
+  Sentinel string
+  //Cluster connects to a Redis Cluster
+  Cluster bool
+  //PoolSize is the number of connections kept open
+  PoolSize int
+  //Timeout limits dialing and every command, it is not
+  //applied if it is zero
+  Timeout time.Duration
+  //Namespace prefixes every key written by the cache
+  Namespace string
+}
+
+//ParseRedisURL reads RedisOptions from a URL of the form
+//
+//  redis://[[user]:password@]host[:port][/db][?option=value]
+//
+//The rediss scheme enables TLS.  The options are namespace,
+//pool_size, timeout (a duration such as 5s), sentinel (the
+//master name, Addr is then a sentinel) and cluster (true to
+//use Redis Cluster)
+func ParseRedisURL(rawurl string) (RedisOptions, error) {
+  var o RedisOptions
+  u, err := url.Parse(rawurl)
+  if err != nil {
+    return o, err
+  }
+  switch u.Scheme {
+  case "redis":
+  case "rediss":
+    o.TLS = &tls.Config{}
+  default:
+    return o, fmt.Errorf("unsupported redis URL scheme %q", u.Scheme)
+  }
+  if u.User != nil {
+    o.Username = u.User.Username()
+    o.Password, _ = u.User.Password()
+  }
+
+  q := u.Query()
+  for k, v := range q {
+    switch k {
+    case "namespace":
+      o.Namespace = v[0]
+    case "pool_size":
+      if o.PoolSize, err = strconv.Atoi(v[0]); err != nil {
+        return o, fmt.Errorf("invalid pool_size %q", v[0])
+      }
+    case "timeout":
+      if o.Timeout, err = time.ParseDuration(v[0]); err != nil {
+        return o, fmt.Errorf("invalid timeout %q", v[0])
+      }
+    case "sentinel":
+      o.Sentinel = v[0]
+    case "cluster":
+      if o.Cluster, err = strconv.ParseBool(v[0]); err != nil {
+        return o, fmt.Errorf("invalid cluster %q", v[0])
+      }
+    default:
+      return o, fmt.Errorf("unknown redis URL option %q", k)
+    }
+  }
+
+  if u.Hostname() == "" {
+    return o, errors.New("redis URL has no host")
+  }
+  o.Addr = u.Host
+  if u.Port() == "" {
+    port := "6379"
+    if o.Sentinel != "" {
+      port = "26379"
+    }
+    o.Addr = net.JoinHostPort(u.Hostname(), port)
+  }
+  if db := strings.Trim(u.Path, "/"); db != "" {
+    if o.DB, err = strconv.Atoi(db); err != nil {
+      return o, fmt.Errorf("invalid redis database %q", db)
+    }
+  }
+  return o, o.validate()
+}
+
+//validate reports options that can not be used together
+func (o RedisOptions) validate() error {
+  switch {
+  case o.Addr == "":
+    return errors.New("redis address is missing")
+  case o.Cluster && o.Sentinel != "":
+    return errors.New("redis cluster can not be used with sentinel")
+  case o.Cluster && o.DB != 0:
+    return errors.New("redis cluster only has database 0")
+  case o.DB < 0:
+    return errors.New("redis database can not be negative")
+  }
+  return nil
+}
+
+//dial opens a connection to addr and authenticates and selects
+//the database on it
+func (o RedisOptions) dial(network string, addr string) (*redis.Client, error) {
+  var c *redis.Client
+  var err error
+  if o.TLS != nil {
+    conn, err := tls.DialWithDialer(&net.Dialer{Timeout: o.Timeout}, network, addr, o.TLS)
+    if err != nil {
+      return nil, err
+    }
+    if c, err = redis.NewClient(conn); err != nil {
+      conn.Close()
+      return nil, err
+    }
+    //redis.DialTimeout does this for plain connections
+    c.ReadTimeout = o.Timeout
+    c.WriteTimeout = o.Timeout
+  } else if c, err = redis.DialTimeout(network, addr, o.Timeout); err != nil {
+    return nil, err
+  }
+
+  if o.Password != "" {
+    if o.Username != "" {
+      err = c.Cmd("AUTH", o.Username, o.Password).Err
+    } else {
+      err = c.Cmd("AUTH", o.Password).Err
+    }
+    if err != nil {
+      c.Close()
+      return nil, err
+    }
+  }
+  if o.DB != 0 {
+    if err = c.Cmd("SELECT", o.DB).Err; err != nil {
+      c.Close()
+      return nil, err
+    }
+  }
+  return c, nil
+}
+
+//masterAddr asks the sentinel at o.Addr for the address of the
+//master named o.Sentinel
+func (o RedisOptions) masterAddr() (string, error) {
+  //sentinels only have database 0
+  so := o
+  so.DB = 0
+  c, err := so.dial("tcp", o.Addr)
+  if err != nil {
+    return "", err
+  }
+  defer c.Close()
+  resp := c.Cmd("SENTINEL", "get-master-addr-by-name", o.Sentinel)
+  if resp.IsType(redis.Nil) {
+    return "", fmt.Errorf("redis sentinel does not know master %q", o.Sentinel)
+  }
+  a, err := resp.List()
+  if err != nil {
+    return "", err
+  }
+  if len(a) != 2 {
+    return "", fmt.Errorf("invalid redis sentinel reply %q", a)
+  }
+  return net.JoinHostPort(a[0], a[1]), nil
+}
+
+//sentinelCmder runs every command on a pool connected to the
+//master reported by the sentinel.  The sentinel is asked again
+//when a command fails because the master went away or has
+//become a replica
+type sentinelCmder struct {
+  o RedisOptions
+  dial pool.DialFunc
+  mu sync.Mutex
+  addr string
+  pool *pool.Pool
+}
+
+func newSentinelCmder(o RedisOptions, dial pool.DialFunc) (*sentinelCmder, error) {
+  s := &sentinelCmder{o: o, dial: dial}
+  if _, err := s.master(nil); err != nil {
+    return nil, err
+  }
+  return s, nil
+}
+
+//master returns the pool of the current master.  The sentinel
+//is asked for the master first if there is no pool yet or the
+//current pool is stale
+func (s *sentinelCmder) master(stale *pool.Pool) (*pool.Pool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.pool != nil && s.pool != stale {
+    return s.pool, nil
+  }
+  addr, err := s.o.masterAddr()
+  if err != nil {
+    return nil, err
+  }
+  if s.pool != nil && addr == s.addr {
+    return s.pool, nil
+  }
+  p, err := pool.NewCustom("tcp", addr, s.o.PoolSize, s.dial)
+  if err != nil {
+    return nil, err
+  }
+  if s.pool != nil {
+    s.pool.Empty()
+  }
+  s.addr = addr
+  s.pool = p
+  return p, nil
+}
+
+func (s *sentinelCmder) Cmd(cmd string, args ...interface{}) *redis.Resp {
+  p, err := s.master(nil)
+  if err != nil {
+    return redis.NewResp(err)
+  }
+  resp := p.Cmd(cmd, args...)
+  if resp.IsType(redis.IOErr) ||
+     resp.IsType(redis.AppErr) && strings.HasPrefix(resp.Err.Error(), "READONLY") {
+    s.master(p)
+  }
+  return resp
+}
+
+//Close closes the connections to the master
+func (s *sentinelCmder) Close() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.pool.Empty()
+}
+
+//NewRedisCacheOptions creates a RedisCache connected as
+//described by o.  Any error opening the connections is
+//returned
+func NewRedisCacheOptions(o RedisOptions) (*RedisCache, error) {
+  if err := o.validate(); err != nil {
+    return nil, err
+  }
+  if o.PoolSize == 0 {
+    o.PoolSize = DefaultRedisPoolSize
+  }
+  if o.Namespace == "" {
+    o.Namespace = DefaultRedisNamespace
+  }
+  dial := func(network, addr string) (*redis.Client, error) {
+    return o.dial(network, addr)
+  }
+
+  r := &RedisCache{namespace: o.Namespace, oldIdGrace: DefaultOldIdGrace}
+  switch {
+  case o.Cluster:
+    c, err := cluster.NewWithOpts(cluster.Opts{
+      Addr: o.Addr,
+      PoolSize: o.PoolSize,
+      Timeout: o.Timeout,
+      Dialer: dial,
+    })
+    if err != nil {
+      return nil, err
+    }
+    r.client = c
+    r.close = c.Close
+    r.cluster = true
+  case o.Sentinel != "":
+    c, err := newSentinelCmder(o, dial)
+    if err != nil {
+      return nil, err
+    }
+    r.client = c
+    r.close = c.Close
+  default:
+    p, err := pool.NewCustom("tcp", o.Addr, o.PoolSize, dial)
+    if err != nil {
+      return nil, err
+    }
+    r.client = p
+    r.close = p.Empty
+  }
+  return r, nil
+}
+
+//NewRedisCacheURL creates a RedisCache from a URL, see
+//ParseRedisURL for its format
+func NewRedisCacheURL(rawurl string) (*RedisCache, error) {
+  o, err := ParseRedisURL(rawurl)
+  if err != nil {
+    return nil, err
+  }
+  return NewRedisCacheOptions(o)
+}
@@ -0,0 +1,102 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "regexp"
+  "strings"
+)
+
+//SafetyPolicy keeps requests with side effects that must not
+//be replayed, such as payments or emails, away from staging.
+//Requests it rejects are still reported in a Message that is
+//marked as not mirrored
+type SafetyPolicy struct {
+  //ReadsOnly mirrors only GET, HEAD, OPTIONS and TRACE requests
+  ReadsOnly bool
+  //DenyMethods are methods that are never mirrored
+  DenyMethods []string
+  //DenyPaths are path prefixes that are never mirrored
+  DenyPaths []string
+  //DenyPatterns are path regexes that are never mirrored
+  DenyPatterns []*regexp.Regexp
+  //Headers are set on every staging request, for example
+  //X-Kyogetsu-Shadow: 1 so staging can tell it is a mirror
+  Headers http.Header
+}
+
+//Check returns the reason r must not be mirrored, or an empty
+//string if it is safe.  A nil SafetyPolicy allows everything
+func (s *SafetyPolicy) Check(r *http.Request) string {
+  if s == nil {
+    return ""
+  }
+  if s.ReadsOnly && !isReadMethod(r.Method) {
+    return "method " + r.Method + " is not mirrored in reads only mode"
+  }
+  for _, m := range s.DenyMethods {
+    if strings.EqualFold(r.Method, m) {
+      return "method " + r.Method + " is denied"
+    }
+  }
+  for _, p := range s.DenyPaths {
+    if strings.HasPrefix(r.URL.Path, p) {
+      return "path " + r.URL.Path + " is denied by prefix " + p
+    }
+  }
+  for _, re := range s.DenyPatterns {
+    if re.MatchString(r.URL.Path) {
+      return "path " + r.URL.Path + " is denied by pattern " + re.String()
+    }
+  }
+  return ""
+}
+
+//apply sets the mandatory Headers on a staging request
+func (s *SafetyPolicy) apply(r *http.Request) {
+  if s == nil {
+    return
+  }
+  for k, v := range s.Headers {
+    r.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+  }
+}
+
+func isReadMethod(m string) bool {
+  switch strings.ToUpper(m) {
+  case "GET", "HEAD", "OPTIONS", "TRACE":
+    return true
+  }
+  return false
+}
+
+//sendSkipped reports a request that was not mirrored, with the
+//production side filled in and the reason it was skipped.  Like
+//a mirrored request, each staging target gets its own Message
+func (p KyogetsuProxy) sendSkipped(r *http.Request, pw *httptest.ResponseRecorder, truncated bool, reason string) {
+  id, id_err := p.idFunc.RequestId(r)
+  for _, t := range p.stagingTargets(r) {
+    tp := p.forTarget(t)
+    r.Body = newBody(r)
+    m := &Message{
+      ProdRequest: NewRequestInfo(r),
+      ProdReponse: NewResponseInfo(pw),
+      ProdTruncated: truncated,
+      Outcome: OutcomeSkipped,
+      SkipReason: reason,
+      Target: t.Name,
+    }
+    if id_err == nil {
+      m.ProdSessionId = id
+      if tp.idMap != nil {
+        m.StagingSessionId, _ = tp.idMap.StagingSessionId(id)
+      }
+    }
+    tp.sendMessage(m)
+  }
+}
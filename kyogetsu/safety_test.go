@@ -0,0 +1,112 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "regexp"
+  "strings"
+  "sync/atomic"
+  "testing"
+  )
+
+func TestSafetyPolicyCheck(t *testing.T) {
+  s := &SafetyPolicy{
+    DenyMethods: []string{"delete"},
+    DenyPaths: []string{"/payments"},
+    DenyPatterns: []*regexp.Regexp{regexp.MustCompile(`/webhooks?/`)},
+  }
+  tests := []struct {
+    Policy *SafetyPolicy
+    Method string
+    Path string
+    Skipped bool
+  } {
+    {nil, "POST", "/payments", false},
+    {s, "GET", "/search", false},
+    {s, "POST", "/orders", false},
+    {s, "DELETE", "/orders/1", true},
+    {s, "POST", "/payments/charge", true},
+    {s, "POST", "/api/webhook/stripe", true},
+    {&SafetyPolicy{ReadsOnly: true}, "HEAD", "/", false},
+    {&SafetyPolicy{ReadsOnly: true}, "PUT", "/", true},
+  }
+  for _, test := range tests {
+    reason := test.Policy.Check(newPolicyRequest(test.Method, test.Path))
+    if (reason != "") != test.Skipped {
+      t.Errorf("%s %s: Skipped Expected: %t Got: %q", test.Method, test.Path, test.Skipped, reason)
+    }
+  }
+}
+
+func TestServeHTTPSkipsUnsafeRequests(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+
+  hits := int32(0)
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&hits, 1)
+    fmt.Fprintf(w, "shadow=%s", r.Header.Get("X-Kyogetsu-Shadow"))
+  }))
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  ph := NewSingleProxyHandler(ps.URL, ss.URL)
+  k := NewKyogetsuProxyWithOptions(ph, ms, getMemoryCache(), CookieIdFunction("id"), Options{
+    Safety: &SafetyPolicy{
+      DenyPaths: []string{"/payments"},
+      Headers: http.Header{"X-Kyogetsu-Shadow": {"1"}},
+    },
+  })
+
+  r, _ := http.NewRequest("POST", ps.URL + "/payments", strings.NewReader("amount=10"))
+  k.ServeHTTP(httptest.NewRecorder(), r)
+  m := waitMessage(t, ms)
+  if m.Mirrored || m.Outcome != OutcomeSkipped || m.SkipReason == "" {
+    t.Errorf("Expected a skipped message with a reason Got: %t %s %q", m.Mirrored, m.Outcome, m.SkipReason)
+  }
+  if m.ProdRequest.Body != "amount=10" || m.ProdReponse.Body != "Prod" {
+    t.Errorf("The production side of a skipped message is missing: %v", m)
+  }
+  if atomic.LoadInt32(&hits) != 0 {
+    t.Error("A denied request reached staging")
+  }
+
+  r, _ = http.NewRequest("GET", ps.URL + "/search", nil)
+  k.ServeHTTP(httptest.NewRecorder(), r)
+  m = waitMessage(t, ms)
+  if !m.Mirrored || m.StagingReponse.Body != "shadow=1" {
+    t.Errorf("Expected a mirrored request with the shadow header Got: %t %s", m.Mirrored, m.StagingReponse.Body)
+  }
+}
+
+func TestHandleStagingSkipsUnsafeRequests(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+
+  hits := int32(0)
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&hits, 1)
+  }))
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  ph := NewSingleProxyHandler(ps.URL, ss.URL)
+  k := NewKyogetsuProxyWithOptions(ph, ms, getMemoryCache(), CookieIdFunction("id"),
+                                   Options{Safety: &SafetyPolicy{ReadsOnly: true}})
+
+  r, _ := http.NewRequest("POST", ps.URL + "/orders", strings.NewReader("id=1"))
+  k.HandleStaging(r, httptest.NewRecorder())
+  m := waitMessage(t, ms)
+  if m.Mirrored || m.Outcome != OutcomeSkipped {
+    t.Errorf("Expected a skipped message Got: %t %s", m.Mirrored, m.Outcome)
+  }
+  if atomic.LoadInt32(&hits) != 0 {
+    t.Error("A denied request reached staging")
+  }
+}
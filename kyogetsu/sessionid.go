@@ -0,0 +1,203 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "bytes"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+)
+
+//ErrNoId is returned by an IdExtractor that finds no session id
+var ErrNoId = errors.New("Could not find session id")
+
+//An IdExtractor finds the session id of a user.  RequestId
+//reads it from a request the user sent, ResponseId from a
+//production response that may give the user a new id.  Both
+//return an error if there is no id
+type IdExtractor interface {
+  RequestId(r *http.Request) (string, error)
+  ResponseId(r *http.Response) (string, error)
+}
+
+//RequestId calls the IdFunction with the request's cookies,
+//which lets an IdFunction be used as an IdExtractor
+func (f IdFunction) RequestId(r *http.Request) (string, error) {
+  return f(r.Cookies())
+}
+
+//ResponseId calls the IdFunction with the cookies set by the
+//response
+func (f IdFunction) ResponseId(r *http.Response) (string, error) {
+  return f(r.Cookies())
+}
+
+//idExtractor builds an IdExtractor from two functions, a nil
+//function never finds an id
+type idExtractor struct {
+  request func(*http.Request) (string, error)
+  response func(*http.Response) (string, error)
+}
+
+func (e idExtractor) RequestId(r *http.Request) (string, error) {
+  if e.request == nil {
+    return "", ErrNoId
+  }
+  return e.request(r)
+}
+
+func (e idExtractor) ResponseId(r *http.Response) (string, error) {
+  if e.response == nil {
+    return "", ErrNoId
+  }
+  return e.response(r)
+}
+
+//headerValue returns the value of the header name, or ErrNoId
+//if it is missing or empty
+func headerValue(h http.Header, name string) (string, error) {
+  if v := h.Get(name); v != "" {
+    return v, nil
+  }
+  return "", ErrNoId
+}
+
+//HeaderId uses the value of the named header as the session id.
+//A response that sets the header gives the user a new id
+func HeaderId(name string) IdExtractor {
+  return idExtractor{
+    request: func(r *http.Request) (string, error) {
+      return headerValue(r.Header, name)
+    },
+    response: func(r *http.Response) (string, error) {
+      return headerValue(r.Header, name)
+    },
+  }
+}
+
+//BearerId uses the token of an "Authorization: Bearer" header
+//as the session id.  Responses never give a new id
+func BearerId() IdExtractor {
+  return idExtractor{
+    request: func(r *http.Request) (string, error) {
+      v := r.Header.Get("Authorization")
+      if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+        if t := strings.TrimSpace(v[7:]); t != "" {
+          return t, nil
+        }
+      }
+      return "", ErrNoId
+    },
+  }
+}
+
+//QueryId uses the named query parameter of the request URL as
+//the session id.  Responses never give a new id
+func QueryId(param string) IdExtractor {
+  return idExtractor{
+    request: func(r *http.Request) (string, error) {
+      if v := r.URL.Query().Get(param); v != "" {
+        return v, nil
+      }
+      return "", ErrNoId
+    },
+  }
+}
+
+//JWTClaimId decodes the JWT found by token and uses the named
+//claim of its payload as the session id, for example "sub".
+//The signature is NOT verified, the proxy only needs to tell
+//sessions apart and never trusts the claim
+func JWTClaimId(token IdExtractor, claim string) IdExtractor {
+  return idExtractor{
+    request: func(r *http.Request) (string, error) {
+      t, err := token.RequestId(r)
+      if err != nil {
+        return "", err
+      }
+      return jwtClaim(t, claim)
+    },
+    response: func(r *http.Response) (string, error) {
+      t, err := token.ResponseId(r)
+      if err != nil {
+        return "", err
+      }
+      return jwtClaim(t, claim)
+    },
+  }
+}
+
+//jwtClaim returns the claim of the token's payload as a string
+func jwtClaim(token string, claim string) (string, error) {
+  parts := strings.Split(token, ".")
+  if len(parts) != 3 {
+    return "", errors.New("malformed JWT")
+  }
+  b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+  if err != nil {
+    return "", err
+  }
+  d := json.NewDecoder(bytes.NewReader(b))
+  d.UseNumber()
+  var payload map[string]interface{}
+  if err = d.Decode(&payload); err != nil {
+    return "", err
+  }
+  switch v := payload[claim].(type) {
+  case string:
+    if v != "" {
+      return v, nil
+    }
+  case json.Number:
+    return v.String(), nil
+  case nil:
+  default:
+    return fmt.Sprint(v), nil
+  }
+  return "", ErrNoId
+}
+
+//FirstId tries each IdExtractor in turn and returns the first
+//id found
+func FirstId(e ...IdExtractor) IdExtractor {
+  return idExtractor{
+    request: func(r *http.Request) (string, error) {
+      for _, v := range e {
+        if id, err := v.RequestId(r); err == nil {
+          return id, nil
+        }
+      }
+      return "", ErrNoId
+    },
+    response: func(r *http.Response) (string, error) {
+      for _, v := range e {
+        if id, err := v.ResponseId(r); err == nil {
+          return id, nil
+        }
+      }
+      return "", ErrNoId
+    },
+  }
+}
+
+//recordedResponse turns a recorded response to r into an
+//*http.Response for ResponseId
+func recordedResponse(w *httptest.ResponseRecorder, r *http.Request) *http.Response {
+  return &http.Response{
+    Status: http.StatusText(w.Code),
+    StatusCode: w.Code,
+    Header: w.Header(),
+    Body: ioutil.NopCloser(bytes.NewReader(w.Body.Bytes())),
+    ContentLength: int64(w.Body.Len()),
+    Request: r,
+  }
+}
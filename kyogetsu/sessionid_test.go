@@ -0,0 +1,147 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "encoding/base64"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  )
+
+//testJWT builds an unsigned token with the given payload
+func testJWT(payload string) string {
+  e := base64.RawURLEncoding
+  return e.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+         e.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestRequestId(t *testing.T) {
+  bearer := "Bearer " + testJWT(`{"sub":"user-1","uid":42,"empty":""}`)
+  tests := []struct {
+    Name string
+    Extractor IdExtractor
+    URL string
+    Header http.Header
+    Id string
+  } {
+    {"cookie", CookieIdFunction("id"), "/", http.Header{"Cookie": {"id=bob"}}, "bob"},
+    {"cookie missing", CookieIdFunction("id"), "/", http.Header{}, ""},
+    {"header", HeaderId("X-Session"), "/", http.Header{"X-Session": {"abc"}}, "abc"},
+    {"header missing", HeaderId("X-Session"), "/", http.Header{}, ""},
+    {"bearer", BearerId(), "/", http.Header{"Authorization": {"Bearer tok"}}, "tok"},
+    {"bearer lowercase", BearerId(), "/", http.Header{"Authorization": {"bearer tok"}}, "tok"},
+    {"basic auth", BearerId(), "/", http.Header{"Authorization": {"Basic dXNlcg=="}}, ""},
+    {"empty bearer", BearerId(), "/", http.Header{"Authorization": {"Bearer "}}, ""},
+    {"query", QueryId("sid"), "/path?sid=q1", http.Header{}, "q1"},
+    {"query missing", QueryId("sid"), "/path?other=q1", http.Header{}, ""},
+    {"jwt sub", JWTClaimId(BearerId(), "sub"), "/", http.Header{"Authorization": {bearer}}, "user-1"},
+    {"jwt number", JWTClaimId(BearerId(), "uid"), "/", http.Header{"Authorization": {bearer}}, "42"},
+    {"jwt empty claim", JWTClaimId(BearerId(), "empty"), "/", http.Header{"Authorization": {bearer}}, ""},
+    {"jwt missing claim", JWTClaimId(BearerId(), "email"), "/", http.Header{"Authorization": {bearer}}, ""},
+    {"jwt malformed", JWTClaimId(BearerId(), "sub"), "/", http.Header{"Authorization": {"Bearer a.b"}}, ""},
+    {"jwt in cookie", JWTClaimId(CookieIdFunction("jwt"), "sub"), "/",
+      http.Header{"Cookie": {"jwt=" + testJWT(`{"sub":"c"}`)}}, "c"},
+    {"first of", FirstId(HeaderId("X-Session"), CookieIdFunction("id")), "/",
+      http.Header{"Cookie": {"id=bob"}}, "bob"},
+    {"first of order", FirstId(HeaderId("X-Session"), CookieIdFunction("id")), "/",
+      http.Header{"Cookie": {"id=bob"}, "X-Session": {"abc"}}, "abc"},
+    {"first of none", FirstId(HeaderId("X-Session"), QueryId("sid")), "/", http.Header{}, ""},
+  }
+  for _, test := range tests {
+    r := httptest.NewRequest("GET", test.URL, nil)
+    r.Header = test.Header
+    id, err := test.Extractor.RequestId(r)
+    if test.Id == "" && err == nil {
+      t.Errorf("%s: Expected an error Got: %s", test.Name, id)
+    }
+    if id != test.Id {
+      t.Errorf("%s: Expected: %s Got: %s", test.Name, test.Id, id)
+    }
+  }
+}
+
+func TestResponseId(t *testing.T) {
+  tests := []struct {
+    Name string
+    Extractor IdExtractor
+    Header http.Header
+    Id string
+  } {
+    {"cookie", CookieIdFunction("id"), http.Header{"Set-Cookie": {"id=new; Path=/"}}, "new"},
+    {"header", HeaderId("X-Session"), http.Header{"X-Session": {"abc"}}, "abc"},
+    {"bearer", BearerId(), http.Header{"Authorization": {"Bearer tok"}}, ""},
+    {"query", QueryId("sid"), http.Header{}, ""},
+    {"jwt", JWTClaimId(HeaderId("X-Token"), "sub"), http.Header{"X-Token": {testJWT(`{"sub":"s"}`)}}, "s"},
+    {"first of", FirstId(BearerId(), HeaderId("X-Session")), http.Header{"X-Session": {"abc"}}, "abc"},
+  }
+  for _, test := range tests {
+    id, err := test.Extractor.ResponseId(&http.Response{Header: test.Header})
+    if test.Id == "" && err == nil {
+      t.Errorf("%s: Expected an error Got: %s", test.Name, id)
+    }
+    if id != test.Id {
+      t.Errorf("%s: Expected: %s Got: %s", test.Name, test.Id, id)
+    }
+  }
+}
+
+func TestHandleStagingHeaderId(t *testing.T) {
+  ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("X-Session", "rotated")
+  }))
+  defer ps.Close()
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.SetCookie(w, &http.Cookie{Name: "staging", Value: r.Header.Get("X-Session")})
+  }))
+  defer ss.Close()
+
+  ms := make(chanSender, 1)
+  fc := getMemoryCache()
+  k := NewKyogetsuProxyWithOptions(NewSingleProxyHandler(ps.URL, ss.URL), ms, fc, nil,
+                                   Options{IdExtractor: HeaderId("X-Session")})
+  fc.SetCookie("first", &http.Cookie{Name: "old", Value: "cookie"})
+
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  r.Header.Set("X-Session", "first")
+  k.ServeHTTP(httptest.NewRecorder(), r)
+  waitMessage(t, ms)
+
+  c, _ := fc.GetCookies("rotated")
+  if len(c) != 2 {
+    t.Errorf("Expected the cookies to move to the rotated id Got: %v", c)
+  }
+  //in flight requests of the old id use it until the grace period is over
+  if c, _ = fc.GetCookies("first"); len(c) != 1 {
+    t.Errorf("Expected the old id to keep its cookies Got: %v", c)
+  }
+}
+
+func TestNewKyogetsuProxyTakesPlainFunction(t *testing.T) {
+  f := func(c []*http.Cookie) (string, error) { return "plain", nil }
+  k := NewKyogetsuProxy(SingleProxyHandler{}, dummySender{}, getMemoryCache(), f)
+  if id, _ := k.idFunc.RequestId(newTestRequest()); id != "plain" {
+    t.Errorf("Expected: plain Got: %s", id)
+  }
+}
+
+func TestSessionSamplePolicyIdExtractor(t *testing.T) {
+  tests := []struct {
+    Percent float64
+    Expected bool
+  } {
+    {0, false},
+    {100, true},
+  }
+  for _, test := range tests {
+    s := SessionSamplePolicy{Percent: test.Percent, IdExtractor: HeaderId("X-Session"), NoId: SkipNoId}
+    r := newPolicyRequest("GET", "/")
+    r.Header.Set("X-Session", "bob")
+    if got := s.ShouldMirror(r); got != test.Expected {
+      t.Errorf("Percent %f: Expected: %t Got: %t", test.Percent, test.Expected, got)
+    }
+  }
+}
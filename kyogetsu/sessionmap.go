@@ -0,0 +1,82 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httptest"
+)
+
+//A SessionIdMap links each production session id to the id of
+//the staging session it is mirrored into, in both directions.
+//A CookieCache that implements it keeps the map next to the
+//cookies and the proxy records the ids on every Message
+type SessionIdMap interface {
+  //Links prodId and stagingId, removing any older link either
+  //of them had, so a rotated id on one side replaces the old
+  //one
+  MapSessionIds(prodId string, stagingId string) error
+  //Returns the staging session id linked to prodId
+  StagingSessionId(prodId string) (string, error)
+  //Returns the production session id linked to stagingId
+  ProdSessionId(stagingId string) (string, error)
+}
+
+//stagingSessionId finds the id of the staging session that the
+//production session id was mirrored into, links the two in the
+//SessionIdMap and returns it.  A new id set by the staging
+//response wins over the one sent in the staging request sr.
+//If staging shows no id the linked one is returned
+func (p KyogetsuProxy) stagingSessionId(id string, sr *http.Request, sw *httptest.ResponseRecorder) string {
+  f := p.opts.StagingIdFunc
+  if f == nil {
+    f = p.idFunc
+  }
+  sid, err := f.ResponseId(recordedResponse(sw, sr))
+  if err != nil {
+    sid, err = f.RequestId(sr)
+  }
+  if p.idMap == nil || id == "" {
+    return sid
+  }
+  if err != nil {
+    sid, _ = p.idMap.StagingSessionId(id)
+    return sid
+  }
+  p.idMap.MapSessionIds(id, sid)
+  return sid
+}
+
+//namespacedIdMap stores the session id links of a staging
+//target with both ids prefixed with the target name
+type namespacedIdMap struct {
+  m SessionIdMap
+  ns string
+}
+
+func (n namespacedIdMap) id(id string) string {
+  return n.ns + "/" + id
+}
+
+func (n namespacedIdMap) MapSessionIds(prodId string, stagingId string) error {
+  return n.m.MapSessionIds(n.id(prodId), n.id(stagingId))
+}
+
+func (n namespacedIdMap) StagingSessionId(prodId string) (string, error) {
+  id, err := n.m.StagingSessionId(n.id(prodId))
+  if err != nil {
+    return "", err
+  }
+  return id[len(n.ns) + 1:], nil
+}
+
+func (n namespacedIdMap) ProdSessionId(stagingId string) (string, error) {
+  id, err := n.m.ProdSessionId(n.id(stagingId))
+  if err != nil {
+    return "", err
+  }
+  return id[len(n.ns) + 1:], nil
+}
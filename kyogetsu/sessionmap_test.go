@@ -0,0 +1,164 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+  )
+
+//checkLinks checks that the links of a SessionIdMap match
+//expected, a map of production ids to staging ids where an
+//empty staging id means the production id has no link
+func checkLinks(t *testing.T, name string, m SessionIdMap, expected map[string]string) {
+  for p, s := range expected {
+    got, err := m.StagingSessionId(p)
+    if got != s || (s == "") != (err != nil) {
+      t.Errorf("%s: StagingSessionId(%s) Expected: %q Got: %q %v", name, p, s, got, err)
+    }
+    if s == "" {
+      continue
+    }
+    if got, _ = m.ProdSessionId(s); got != p {
+      t.Errorf("%s: ProdSessionId(%s) Expected: %s Got: %s", name, s, p, got)
+    }
+  }
+}
+
+//testSessionIdMap checks the links of m, c is the CookieCache
+//that stores them
+func testSessionIdMap(t *testing.T, name string, m SessionIdMap, c CookieCache) {
+  m.MapSessionIds("p1", "s1")
+  checkLinks(t, name, m, map[string]string{"p1": "s1"})
+
+  //staging rotates its id
+  m.MapSessionIds("p1", "s2")
+  checkLinks(t, name, m, map[string]string{"p1": "s2"})
+  if _, err := m.ProdSessionId("s1"); err == nil {
+    t.Errorf("%s: The old staging id is still linked", name)
+  }
+
+  //production rotates its id
+  m.MapSessionIds("p2", "s2")
+  checkLinks(t, name, m, map[string]string{"p1": "", "p2": "s2"})
+
+  //production rotates its id and the cookies follow it, before
+  //staging shows its id again
+  c.SetCookie("p2", &http.Cookie{Name: "a", Value: "1"})
+  if err := c.ChangeCookiesId("p2", "p3"); err != nil {
+    t.Errorf("%s: Unexpected Error: %s", name, err)
+  }
+  checkLinks(t, name, m, map[string]string{"p2": "", "p3": "s2"})
+
+  //a session that only has a link also keeps it
+  m.MapSessionIds("p4", "s4")
+  c.ChangeCookiesId("p4", "p5")
+  checkLinks(t, name, m, map[string]string{"p4": "", "p5": "s4"})
+
+  //a new id that is already linked keeps its own link
+  m.MapSessionIds("p6", "s6")
+  c.ChangeCookiesId("p3", "p6")
+  checkLinks(t, name, m, map[string]string{"p6": "s6"})
+}
+
+func TestSessionIdMaps(t *testing.T) {
+  mem := NewMemoryCache(0, 0)
+  testSessionIdMap(t, "memory", mem, mem)
+
+  b, err := NewBoltCache(filepath.Join(t.TempDir(), "cookies.db"), time.Second)
+  if err != nil {
+    t.Fatalf("Unexpected Error: %s", err)
+  }
+  defer b.Close()
+  testSessionIdMap(t, "bolt", b, b)
+
+  mc := NewMemoryCache(0, 0)
+  testSessionIdMap(t, "namespaced", namespacedIdMap{m: mc, ns: "rc1"}, namespacedCookieCache{c: mc, ns: "rc1"})
+  if id, _ := mc.ProdSessionId("rc1/s6"); id != "rc1/p6" {
+    t.Errorf("Expected: rc1/p6 Got: %s", id)
+  }
+}
+
+func TestMemoryCacheLinksFollowSessions(t *testing.T) {
+  m := NewMemoryCache(1, 0)
+  m.SetCookie("p1", &http.Cookie{Name: "a", Value: "1"})
+  m.MapSessionIds("p1", "s1")
+  m.ChangeCookiesId("p1", "p2")
+  checkLinks(t, "rotated", m, map[string]string{"p1": "", "p2": "s1"})
+
+  //evicting the session drops its link
+  m.SetCookie("p3", &http.Cookie{Name: "a", Value: "1"})
+  if _, err := m.ProdSessionId("s1"); err == nil {
+    t.Error("The link of an evicted session was kept")
+  }
+}
+
+func TestHandleStagingMapsSessionIds(t *testing.T) {
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if _, err := r.Cookie("id"); err != nil {
+      http.SetCookie(w, &http.Cookie{Name: "id", Value: "staging-1"})
+    }
+  }))
+  defer ss.Close()
+  ps := newProdServer()
+  defer ps.Close()
+
+  ms := make(chanSender, 2)
+  fc := getMemoryCache()
+  k := newTestKyogetsuProxy(ps, ss, ms, fc)
+  for i := 0; i < 2; i++ {
+    r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+    r.AddCookie(&http.Cookie{Name: "id", Value: "bob"})
+    k.ServeHTTP(httptest.NewRecorder(), r)
+
+    m := waitMessage(t, ms)
+    if m.ProdSessionId != "bob" || m.StagingSessionId != "staging-1" {
+      t.Errorf("Request %d Expected: bob staging-1 Got: %s %s", i, m.ProdSessionId, m.StagingSessionId)
+    }
+  }
+  if id, _ := fc.ProdSessionId("staging-1"); id != "bob" {
+    t.Errorf("Expected: bob Got: %s", id)
+  }
+}
+
+func TestSkippedMessagesLinkTargetSessions(t *testing.T) {
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if _, err := r.Cookie("id"); err != nil {
+      http.SetCookie(w, &http.Cookie{Name: "id", Value: "stag"})
+    }
+  }))
+  defer ss.Close()
+  ps := newProdServer()
+  defer ps.Close()
+
+  ms := make(chanSender, 2)
+  ph := NewMultiProxyHandler(ps.URL, map[string]string{"a": ss.URL, "b": ss.URL})
+  k := NewKyogetsuProxyWithOptions(ph, ms, getMemoryCache(), CookieIdFunction("id"),
+                                   Options{Safety: &SafetyPolicy{DenyMethods: []string{"DELETE"}}})
+  for _, method := range []string{"GET", "DELETE"} {
+    r, _ := http.NewRequest(method, ps.URL + "/", nil)
+    r.AddCookie(&http.Cookie{Name: "id", Value: "bob"})
+    k.ServeHTTP(httptest.NewRecorder(), r)
+
+    targets := []string{}
+    for i := 0; i < 2; i++ {
+      m := waitMessage(t, ms)
+      targets = append(targets, m.Target)
+      if m.StagingSessionId != "stag" {
+        t.Errorf("%s %s: Expected: stag Got: %q", method, m.Target, m.StagingSessionId)
+      }
+    }
+    sort.Strings(targets)
+    if strings.Join(targets, ",") != "a,b" {
+      t.Errorf("%s: Expected a Message for each target Got: %v", method, targets)
+    }
+  }
+}
@@ -0,0 +1,127 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "sync"
+)
+
+//DefaultMaxSessionQueue is the number of mirrors of one session
+//that can wait behind the one running when
+//Options.MaxSessionQueue is not set
+const DefaultMaxSessionQueue = 16
+
+//A SessionQueue runs the staging work of each session strictly
+//in the order it was submitted, while different sessions still
+//run in parallel on a StagingDispatcher.  Only one job per
+//session is given to the dispatcher, the worker running it
+//then runs the jobs that queued up behind it.  At most max
+//jobs can wait per session, further jobs are dropped
+type SessionQueue struct {
+  d *StagingDispatcher
+  max int
+  mu sync.Mutex
+  sessions map[string][]stagingJob
+  accepted uint64
+  dropped uint64
+  completed uint64
+}
+
+//NewSessionQueue creates a SessionQueue feeding d, allowing
+//max jobs to wait per session
+func NewSessionQueue(d *StagingDispatcher, max int) *SessionQueue {
+  return &SessionQueue{d: d, max: max, sessions: map[string][]stagingJob{}}
+}
+
+//Submit queues run behind the jobs already submitted for id.
+//drop, if not nil, is called for a job that is discarded, either
+//because the session's queue is full or because the dispatcher
+//dropped the job the session was waiting on.  Jobs with an
+//empty id have no order and go straight to the dispatcher.
+//Submit reports whether run was queued
+func (q *SessionQueue) Submit(id string, run func(), drop func()) bool {
+  if id == "" {
+    return q.d.Submit(run, drop)
+  }
+  q.mu.Lock()
+  if s, ok := q.sessions[id]; ok {
+    if len(s) >= q.max {
+      q.dropped++
+      q.mu.Unlock()
+      if drop != nil {
+        drop()
+      }
+      return false
+    }
+    q.sessions[id] = append(s, stagingJob{run: run, drop: drop})
+    q.accepted++
+    q.mu.Unlock()
+    return true
+  }
+  q.sessions[id] = nil
+  q.mu.Unlock()
+
+  return q.d.Submit(func() {
+    run()
+    q.drain(id)
+  }, func() {
+    if drop != nil {
+      drop()
+    }
+    q.dropAll(id)
+  })
+}
+
+//Stats returns the dispatcher's counters including the jobs
+//waiting in, and dropped by, the session queues
+func (q *SessionQueue) Stats() DispatcherStats {
+  s := q.d.Stats()
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  s.Accepted += q.accepted
+  s.Dropped += q.dropped
+  s.Completed += q.completed
+  for _, v := range q.sessions {
+    s.Pending += len(v)
+  }
+  return s
+}
+
+//drain runs the jobs waiting for id until there are none left,
+//then forgets the session
+func (q *SessionQueue) drain(id string) {
+  for {
+    q.mu.Lock()
+    s := q.sessions[id]
+    if len(s) == 0 {
+      delete(q.sessions, id)
+      q.mu.Unlock()
+      return
+    }
+    j := s[0]
+    q.sessions[id] = s[1:]
+    q.mu.Unlock()
+    j.run()
+    q.mu.Lock()
+    q.completed++
+    q.mu.Unlock()
+  }
+}
+
+//dropAll discards the jobs waiting for id, they can not run
+//in order once the job ahead of them was dropped
+func (q *SessionQueue) dropAll(id string) {
+  q.mu.Lock()
+  s := q.sessions[id]
+  delete(q.sessions, id)
+  q.dropped += uint64(len(s))
+  q.mu.Unlock()
+  for _, j := range s {
+    if j.drop != nil {
+      j.drop()
+    }
+  }
+}
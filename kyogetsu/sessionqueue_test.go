@@ -0,0 +1,145 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+  )
+
+func TestSessionQueueOrdersSessions(t *testing.T) {
+  q := NewSessionQueue(NewStagingDispatcher(4, 100, DropNewest, 0), 100)
+  var mu sync.Mutex
+  got := map[string][]int{}
+  var wg sync.WaitGroup
+  for i := 0; i < 20; i++ {
+    for _, id := range []string{"a", "b", "c"} {
+      id, i := id, i
+      wg.Add(1)
+      q.Submit(id, func() {
+        defer wg.Done()
+        //later jobs are faster so they would overtake
+        time.Sleep(time.Duration(20 - i) * 100 * time.Microsecond)
+        mu.Lock()
+        got[id] = append(got[id], i)
+        mu.Unlock()
+      }, wg.Done)
+    }
+  }
+  wg.Wait()
+  for id, order := range got {
+    for i, v := range order {
+      if v != i {
+        t.Errorf("Session %s ran out of order: %v", id, order)
+        break
+      }
+    }
+  }
+  if s := q.Stats(); s.Completed != 60 || s.Pending != 0 {
+    t.Errorf("Expected: 60 completed 0 pending Got: %+v", s)
+  }
+}
+
+func TestSessionQueueRunsSessionsInParallel(t *testing.T) {
+  q := NewSessionQueue(NewStagingDispatcher(2, 10, DropNewest, 0), 10)
+  release := make(chan struct{})
+  q.Submit("a", func() { <-release }, nil)
+  ran := make(chan struct{})
+  q.Submit("b", func() { close(ran) }, nil)
+  select {
+  case <-ran:
+  case <-time.After(time.Second):
+    t.Error("Session b waited for session a")
+  }
+  close(release)
+}
+
+func TestSessionQueueBounded(t *testing.T) {
+  q := NewSessionQueue(NewStagingDispatcher(1, 10, DropNewest, 0), 2)
+  release := make(chan struct{})
+  started := make(chan struct{})
+  q.Submit("a", func() {
+    close(started)
+    <-release
+  }, nil)
+  <-started
+
+  dropped := 0
+  for i := 0; i < 3; i++ {
+    q.Submit("a", func() {}, func() { dropped++ })
+  }
+  if dropped != 1 {
+    t.Errorf("Expected: 1 dropped Got: %d", dropped)
+  }
+  if !q.Submit("", func() {}, nil) {
+    t.Error("A job without an id should not wait for a session")
+  }
+  //two waiting for session a and one in the dispatcher
+  s := q.Stats()
+  if s.Dropped != 1 || s.Pending != 3 {
+    t.Errorf("Expected: 1 dropped 3 pending Got: %+v", s)
+  }
+  close(release)
+}
+
+func TestSessionQueueDropsWaitingJobs(t *testing.T) {
+  d, release := blockDispatcher(DropOldest, 1)
+  q := NewSessionQueue(d, 10)
+  dropped := make(chan string, 3)
+  q.Submit("a", func() {}, func() { dropped <- "first" })
+  q.Submit("a", func() {}, func() { dropped <- "second" })
+  //pushes the session's first job out of the dispatcher
+  d.Submit(func() {}, nil)
+
+  for _, name := range []string{"first", "second"} {
+    select {
+    case n := <-dropped:
+      if n != name {
+        t.Errorf("Expected: %s Got: %s", name, n)
+      }
+    case <-time.After(time.Second):
+      t.Errorf("Job %s was not dropped", name)
+    }
+  }
+  close(release)
+}
+
+func TestServeHTTPOrdersSessions(t *testing.T) {
+  var mu sync.Mutex
+  order := []string{}
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    seq := r.URL.Query().Get("seq")
+    if seq == "0" {
+      time.Sleep(50 * time.Millisecond)
+    }
+    mu.Lock()
+    order = append(order, seq)
+    mu.Unlock()
+  }))
+  defer ss.Close()
+  ps := newProdServer()
+  defer ps.Close()
+
+  ms := make(chanSender, 3)
+  k := newTestKyogetsuProxy(ps, ss, ms, getMemoryCache())
+  for i := 0; i < 3; i++ {
+    r, _ := http.NewRequest("GET", fmt.Sprintf("%s/?seq=%d", ps.URL, i), nil)
+    r.AddCookie(&http.Cookie{Name: "id", Value: "bob"})
+    k.ServeHTTP(httptest.NewRecorder(), r)
+  }
+  for i := 0; i < 3; i++ {
+    waitMessage(t, ms)
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  if fmt.Sprint(order) != "[0 1 2]" {
+    t.Errorf("Expected: [0 1 2] Got: %v", order)
+  }
+}
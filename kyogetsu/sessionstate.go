@@ -0,0 +1,232 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "sort"
+  "time"
+)
+
+//A SessionStateCache stores the values, other than cookies, that
+//keep a staging session alive, such as bearer or CSRF tokens.
+//It sits next to the CookieCache and is filled and read by the
+//proxy's CaptureRules
+type SessionStateCache interface {
+  //Stores the values under their names for the session id,
+  //keeping the values already stored under other names
+  SetState(id string, values map[string]string) error
+  //Gets every value stored for the session id
+  GetState(id string) (map[string]string, error)
+  //Change the Id that the values are stored under
+  ChangeStateId(old_id string, new_id string) error
+}
+
+//A CaptureRule copies a value from a staging response into
+//later staging requests of the same session.  The value is
+//read from ResponseHeader, or from the JSON response body at
+//JSONPath if the header is missing, and stored under Name.  It
+//is then set as RequestHeader and/or QueryParam on every
+//following staging request of the session, after Prefix
+type CaptureRule struct {
+  Name string
+  //ResponseHeader is the staging response header holding
+  //the value
+  ResponseHeader string
+  //JSONPath is the path of the value in a JSON response body,
+  //in the same syntax as the JSONComparator rules, for example
+  //"$.data.tokens[0].value"
+  JSONPath string
+  //RequestHeader is the header the value is sent in
+  RequestHeader string
+  //QueryParam is the query parameter the value is sent in
+  QueryParam string
+  //Prefix is put in front of the value when it is sent, for
+  //example "Bearer "
+  Prefix string
+}
+
+//loadState sets the values stored for the session id on the
+//staging request r, following the CaptureRules
+func (p KyogetsuProxy) loadState(id string, r *http.Request) error {
+  if p.state == nil || len(p.opts.CaptureRules) == 0 {
+    return nil
+  }
+  s, err := p.state.GetState(id)
+  if err != nil {
+    return err
+  }
+  q := r.URL.Query()
+  query := false
+  for _, rule := range p.opts.CaptureRules {
+    v, ok := s[rule.Name]
+    if !ok {
+      continue
+    }
+    if rule.RequestHeader != "" {
+      r.Header.Set(rule.RequestHeader, rule.Prefix + v)
+    }
+    if rule.QueryParam != "" {
+      q.Set(rule.QueryParam, rule.Prefix + v)
+      query = true
+    }
+  }
+  if query {
+    r.URL.RawQuery = q.Encode()
+  }
+  return nil
+}
+
+//saveState stores the values the CaptureRules find in the
+//staging response w for the session id
+func (p KyogetsuProxy) saveState(id string, w *httptest.ResponseRecorder) error {
+  if p.state == nil || len(p.opts.CaptureRules) == 0 {
+    return nil
+  }
+  s := map[string]string{}
+  for _, rule := range p.opts.CaptureRules {
+    if v := w.Header().Get(rule.ResponseHeader); rule.ResponseHeader != "" && v != "" {
+      s[rule.Name] = v
+    } else if rule.JSONPath != "" {
+      if v, ok := jsonLookup(w.Body.Bytes(), rule.JSONPath); ok {
+        s[rule.Name] = v
+      }
+    }
+  }
+  if len(s) == 0 {
+    return nil
+  }
+  return p.state.SetState(id, s)
+}
+
+//jsonLookup returns the value at the JSONPath path of the JSON
+//document b as a string.  If the path has wildcards the first
+//value it matches is used, object keys being visited in sorted
+//order.  Objects, arrays and nulls are not values
+func jsonLookup(b []byte, path string) (string, bool) {
+  pattern, err := parseJSONPath(path)
+  if err != nil {
+    return "", false
+  }
+  d := json.NewDecoder(bytes.NewReader(b))
+  d.UseNumber()
+  var v interface{}
+  if d.Decode(&v) != nil {
+    return "", false
+  }
+  return jsonFind(pattern, v)
+}
+
+//jsonFind returns the first value under v matching pattern
+func jsonFind(pattern []jsonSeg, v interface{}) (string, bool) {
+  if len(pattern) == 0 {
+    switch n := v.(type) {
+    case string:
+      return n, true
+    case json.Number, bool:
+      return fmt.Sprint(n), true
+    }
+    return "", false
+  }
+  p := pattern[0]
+  if p.deep {
+    //.. matches v itself or anything below it
+    if s, ok := jsonFind(pattern[1:], v); ok {
+      return s, true
+    }
+    return jsonFindChild(v, func(c interface{}) (string, bool) { return jsonFind(pattern, c) })
+  }
+  if p.any {
+    return jsonFindChild(v, func(c interface{}) (string, bool) { return jsonFind(pattern[1:], c) })
+  }
+  switch n := v.(type) {
+  case map[string]interface{}:
+    if c, ok := n[p.key]; ok && !p.isIndex {
+      return jsonFind(pattern[1:], c)
+    }
+  case []interface{}:
+    if p.isIndex && p.index < len(n) {
+      return jsonFind(pattern[1:], n[p.index])
+    }
+  }
+  return "", false
+}
+
+//jsonFindChild returns the first value f finds in a child of v
+func jsonFindChild(v interface{}, f func(interface{}) (string, bool)) (string, bool) {
+  switch n := v.(type) {
+  case map[string]interface{}:
+    keys := make([]string, 0, len(n))
+    for k := range n {
+      keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+      if s, ok := f(n[k]); ok {
+        return s, true
+      }
+    }
+  case []interface{}:
+    for _, c := range n {
+      if s, ok := f(c); ok {
+        return s, true
+      }
+    }
+  }
+  return "", false
+}
+
+//A SessionStateCache that keeps the values in memory, with the
+//same session limit, LRU eviction and TTL as a MemoryCache
+type MemoryStateCache struct {
+  c *MemoryCache
+}
+
+//NewMemoryStateCache creates a MemoryStateCache holding at
+//most maxSessions sessions, each expiring when it has not been
+//used for ttl.  A maxSessions or ttl of zero disables the limit
+func NewMemoryStateCache(maxSessions int, ttl time.Duration) *MemoryStateCache {
+  return &MemoryStateCache{c: NewMemoryCache(maxSessions, ttl)}
+}
+
+//SetState stores the values for the session id
+func (m *MemoryStateCache) SetState(id string, values map[string]string) error {
+  c := make([]*http.Cookie, 0, len(values))
+  for k, v := range values {
+    c = append(c, &http.Cookie{Name: k, Value: v})
+  }
+  return m.c.SetCookies(id, c)
+}
+
+//GetState gets every value stored for the session id
+func (m *MemoryStateCache) GetState(id string) (map[string]string, error) {
+  c, err := m.c.GetCookies(id)
+  if err != nil {
+    return nil, err
+  }
+  s := make(map[string]string, len(c))
+  for _, v := range c {
+    s[v.Name] = v.Value
+  }
+  return s, nil
+}
+
+//ChangeStateId merges the values of old_id into new_id, the
+//values of old_id winning.  old_id is removed after the grace
+//period, DefaultOldIdGrace.  Nothing happens if old_id has no
+//values
+func (m *MemoryStateCache) ChangeStateId(old_id string, new_id string) error {
+  return m.c.ChangeCookiesId(old_id, new_id)
+}
+
+//Stats returns a snapshot of the cache's counters
+func (m *MemoryStateCache) Stats() MemoryCacheStats {
+  return m.c.Stats()
+}
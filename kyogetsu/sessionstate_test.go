@@ -0,0 +1,112 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  )
+
+func TestJSONLookup(t *testing.T) {
+  body := []byte(`{"token": "abc", "data": {"csrf": "xyz", "ids": [7, {"v": true}]}, "none": null}`)
+  tests := []struct {
+    Path string
+    Value string
+    Found bool
+  } {
+    {"$.token", "abc", true},
+    {"$.data.csrf", "xyz", true},
+    {"$['data']['csrf']", "xyz", true},
+    {"$.data.ids[0]", "7", true},
+    {"$.data.ids[1].v", "true", true},
+    {"$.data.ids[*].v", "true", true},
+    {"$..v", "true", true},
+    {"$.*.csrf", "xyz", true},
+    {"$.data.ids[2]", "", false},
+    {"$.data.ids.x", "", false},
+    {"$.data", "", false},
+    {"$.none", "", false},
+    {"$.missing.path", "", false},
+    {"$.token.deeper", "", false},
+    {"token", "", false},
+  }
+  for _, test := range tests {
+    v, ok := jsonLookup(body, test.Path)
+    if v != test.Value || ok != test.Found {
+      t.Errorf("%s: Expected: %s %t Got: %s %t", test.Path, test.Value, test.Found, v, ok)
+    }
+  }
+  if _, ok := jsonLookup([]byte("not json"), "$.token"); ok {
+    t.Error("Found a value in a body that is not JSON")
+  }
+}
+
+func TestMemoryStateCache(t *testing.T) {
+  m := NewMemoryStateCache(0, 0)
+  m.SetState("bob", map[string]string{"token": "a", "csrf": "b"})
+  m.SetState("bob", map[string]string{"token": "c"})
+
+  s, err := m.GetState("bob")
+  if err != nil || len(s) != 2 || s["token"] != "c" || s["csrf"] != "b" {
+    t.Errorf("Expected: map[csrf:b token:c] Got: %v %v", s, err)
+  }
+  if err = m.ChangeStateId("bob", "bill"); err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if s, _ = m.GetState("bill"); s["token"] != "c" {
+    t.Errorf("The state was not moved: %v", s)
+  }
+  if err = m.ChangeStateId("nobody", "bill"); err != nil {
+    t.Errorf("Changing a missing id should do nothing Got: %s", err)
+  }
+  if s, _ = m.GetState("nobody"); len(s) != 0 {
+    t.Errorf("Expected no state Got: %v", s)
+  }
+}
+
+func TestHandleStagingCapturesState(t *testing.T) {
+  seen := make(chan *http.Request, 2)
+  ss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    seen <- r
+    if r.URL.Path == "/login" {
+      w.Header().Set("X-Session-Token", "staging-token")
+      fmt.Fprint(w, `{"csrf": "staging-csrf"}`)
+    }
+  }))
+  defer ss.Close()
+  ps := newProdServer()
+  defer ps.Close()
+
+  ms := make(chanSender, 2)
+  st := NewMemoryStateCache(0, 0)
+  k := NewKyogetsuProxyWithOptions(NewSingleProxyHandler(ps.URL, ss.URL), ms, getMemoryCache(),
+                                   CookieIdFunction("id"), Options{
+    SessionState: st,
+    CaptureRules: []CaptureRule{
+      {Name: "token", ResponseHeader: "X-Session-Token", RequestHeader: "Authorization", Prefix: "Bearer "},
+      {Name: "csrf", JSONPath: "$.csrf", QueryParam: "csrf"},
+    },
+  })
+
+  for _, p := range []string{"/login", "/account?page=2"} {
+    r, _ := http.NewRequest("GET", ps.URL + p, nil)
+    r.AddCookie(&http.Cookie{Name: "id", Value: "bob"})
+    r.Header.Set("Authorization", "Bearer production-token")
+    k.ServeHTTP(httptest.NewRecorder(), r)
+    waitMessage(t, ms)
+  }
+
+  <-seen
+  r := <-seen
+  if a := r.Header.Get("Authorization"); a != "Bearer staging-token" {
+    t.Errorf("Expected: Bearer staging-token Got: %s", a)
+  }
+  if q := r.URL.Query(); q.Get("csrf") != "staging-csrf" || q.Get("page") != "2" {
+    t.Errorf("Expected the csrf and page parameters Got: %s", r.URL.RawQuery)
+  }
+}
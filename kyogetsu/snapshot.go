@@ -0,0 +1,147 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "bytes"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+)
+
+//A RequestSnapshot holds a copy of a request body that has been
+//read exactly once.  Each leg of the proxy and the Message can
+//then get their own independent reader over the same bytes.
+//Small bodies are kept in memory, larger ones are spilled to a
+//temporary file that is removed by Close
+type RequestSnapshot struct {
+  mem []byte
+  file *os.File
+  size int64
+  complete bool
+  err error
+}
+
+//NewRequestSnapshot reads the body of r, keeping at most max
+//bytes.  Bodies larger than spill bytes are written to a temp
+//file in dir (the default temp directory if dir is empty).
+//
+//The body is read before the request is sent upstream, so a
+//mirrored request reaches production only once its whole body,
+//up to max bytes, has been uploaded by the client.
+//
+//r.Body is replaced so the request can still be sent upstream.
+//If the body is larger than max, or could not be fully read,
+//the snapshot is incomplete and r.Body continues with the part
+//of the original body that was not read
+func NewRequestSnapshot(r *http.Request, max int64, spill int64, dir string) (*RequestSnapshot, error) {
+  s := &RequestSnapshot{complete: true}
+  if r.Body == nil || r.Body == http.NoBody {
+    return s, nil
+  }
+
+  orig := r.Body
+  buf := &bytes.Buffer{}
+  n, err := io.Copy(buf, io.LimitReader(orig, min64(spill, max) + 1))
+  if err == nil && n > spill && spill < max {
+    err = s.spillToFile(buf, orig, max, dir)
+  } else {
+    s.mem = buf.Bytes()
+    s.size = n
+  }
+
+  if err != nil || s.size > max {
+    s.complete = false
+    s.err = err
+    r.Body = readCloser{io.MultiReader(s.NewReader(), orig), orig}
+    return s, err
+  }
+  orig.Close()
+  r.Body = s.NewReader()
+  r.ContentLength = s.size
+  r.GetBody = s.GetBody
+  return s, nil
+}
+
+//spillToFile moves the bytes already read into a temp file and
+//copies up to max + 1 bytes of the body into it
+func (s *RequestSnapshot) spillToFile(buf *bytes.Buffer, body io.Reader, max int64, dir string) error {
+  f, err := ioutil.TempFile(dir, "kyogetsu-body-")
+  if err != nil {
+    s.mem = buf.Bytes()
+    s.size = int64(buf.Len())
+    return err
+  }
+  s.file = f
+  //the file is only read back by this process and removed by
+  //Close, so it is never synced to disk
+  s.size, err = io.Copy(f, io.MultiReader(buf, io.LimitReader(body, max + 1 - int64(buf.Len()))))
+  return err
+}
+
+//NewReader returns a new reader over the captured body.  If the
+//snapshot is incomplete only the captured part is returned.
+//Readers are independent and safe to use concurrently
+func (s *RequestSnapshot) NewReader() io.ReadCloser {
+  if s.file != nil {
+    return ioutil.NopCloser(io.NewSectionReader(s.file, 0, s.size))
+  }
+  if len(s.mem) == 0 {
+    return http.NoBody
+  }
+  return ioutil.NopCloser(bytes.NewReader(s.mem))
+}
+
+//GetBody returns a new reader over the captured body, it
+//matches the signature of http.Request.GetBody
+func (s *RequestSnapshot) GetBody() (io.ReadCloser, error) {
+  return s.NewReader(), nil
+}
+
+//Size returns the number of bytes captured
+func (s *RequestSnapshot) Size() int64 {
+  return s.size
+}
+
+//Complete reports whether the whole body was captured
+func (s *RequestSnapshot) Complete() bool {
+  return s.complete
+}
+
+//Err returns the error, if any, that stopped the body from
+//being captured
+func (s *RequestSnapshot) Err() error {
+  return s.err
+}
+
+//Close releases the temp file used by the snapshot, if any.
+//Readers must not be used after Close
+func (s *RequestSnapshot) Close() error {
+  if s.file == nil {
+    return nil
+  }
+  name := s.file.Name()
+  err := s.file.Close()
+  if rerr := os.Remove(name); err == nil {
+    err = rerr
+  }
+  s.file = nil
+  return err
+}
+
+//readCloser joins a Reader with the Closer of the body it wraps
+type readCloser struct {
+  io.Reader
+  io.Closer
+}
+
+func min64(a int64, b int64) int64 {
+  if a < b {
+    return a
+  }
+  return b
+}
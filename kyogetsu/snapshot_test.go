@@ -0,0 +1,94 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "testing"
+  )
+
+func readAllString(t *testing.T, s *RequestSnapshot) string {
+  b, err := ioutil.ReadAll(s.NewReader())
+  if err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  return string(b)
+}
+
+func TestRequestSnapshot(t *testing.T) {
+  tests := []struct {
+    Body string
+    Max int64
+    Spill int64
+    Complete bool
+    Spilled bool
+  } {
+    {"small body", 100, 50, true, false},
+    {"a body that is spilled to disk", 100, 10, true, true},
+    {"exactly ten", 11, 11, true, false},
+    {"a body that is much too large", 10, 100, false, false},
+    {"a spilled body that is too large", 20, 10, false, true},
+  }
+  for _, test := range tests {
+    r, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(test.Body))
+    s, _ := NewRequestSnapshot(r, test.Max, test.Spill, "")
+
+    if s.Complete() != test.Complete {
+      t.Errorf("Complete Expected: %t Got: %t", test.Complete, s.Complete())
+    }
+    if (s.file != nil) != test.Spilled {
+      t.Errorf("Spilled Expected: %t Got: %t", test.Spilled, s.file != nil)
+    }
+
+    //production must always see the full body
+    b, _ := ioutil.ReadAll(r.Body)
+    if string(b) != test.Body {
+      t.Errorf("Request Body Expected: %s Got: %s", test.Body, b)
+    }
+    if test.Complete {
+      for i := 0; i < 2; i++ {
+        if got := readAllString(t, s); got != test.Body {
+          t.Errorf("Snapshot Body Expected: %s Got: %s", test.Body, got)
+        }
+      }
+    }
+
+    var name string
+    if s.file != nil {
+      name = s.file.Name()
+    }
+    s.Close()
+    if name != "" {
+      if _, err := ioutil.ReadFile(name); err == nil {
+        t.Errorf("Temp file %s was not removed", name)
+      }
+    }
+  }
+}
+
+func TestRequestSnapshotReadError(t *testing.T) {
+  r, _ := http.NewRequest("POST", "http://example.com/", failReader{})
+  s, err := NewRequestSnapshot(r, 100, 10, "")
+  if err == nil {
+    t.Error("Expected the read error to be returned")
+  }
+  if s.Complete() {
+    t.Error("A snapshot with a read error should not be complete")
+  }
+}
+
+func TestRequestSnapshotNoBody(t *testing.T) {
+  r, _ := http.NewRequest("GET", "http://example.com/", nil)
+  s, err := NewRequestSnapshot(r, 100, 10, "")
+  if err != nil {
+    t.Errorf("Unexpected Error: %s", err)
+  }
+  if !s.Complete() || s.Size() != 0 {
+    t.Error("An empty body should give an empty complete snapshot")
+  }
+}
@@ -0,0 +1,170 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httputil"
+  "net/url"
+  "sort"
+  "sync/atomic"
+)
+
+//StagingTarget is a named staging ReverseProxy.  Each target
+//gets its own cookie namespace and its own Message
+type StagingTarget struct {
+  Name string
+  Proxy *httputil.ReverseProxy
+}
+
+//A MultiStagingHandler is a ProxyHandler that mirrors each
+//request to several staging targets
+type MultiStagingHandler interface {
+  ProxyHandler
+  StagingTargets(*http.Request) []StagingTarget
+}
+
+//MultiProxyHandler is a stuct that impliments the
+//MultiStagingHandler, providing a single production
+//ReverseProxy and a fixed list of staging targets
+type MultiProxyHandler struct {
+  ProductionProxy *httputil.ReverseProxy
+  Targets []StagingTarget
+}
+
+//Production returns the ProductionProxy
+func (p MultiProxyHandler) Production(*http.Request) *httputil.ReverseProxy {
+  return p.ProductionProxy
+}
+
+//Staging returns the proxy of the first target
+func (p MultiProxyHandler) Staging(*http.Request) *httputil.ReverseProxy {
+  if len(p.Targets) == 0 {
+    return nil
+  }
+  return p.Targets[0].Proxy
+}
+
+//StagingTargets returns the Targets
+func (p MultiProxyHandler) StagingTargets(*http.Request) []StagingTarget {
+  return p.Targets
+}
+
+//NewMultiProxyHandler returns a new MultiProxyHandler by parsing
+//the production URL p and the staging URLs in s, which are keyed
+//by target name.  Targets are ordered by name
+func NewMultiProxyHandler(p string, s map[string]string) MultiProxyHandler {
+  pURL, _ := url.Parse(p)
+  h := MultiProxyHandler{ProductionProxy: httputil.NewSingleHostReverseProxy(pURL)}
+  names := make([]string, 0, len(s))
+  for n := range s {
+    names = append(names, n)
+  }
+  sort.Strings(names)
+  for _, n := range names {
+    sURL, _ := url.Parse(s[n])
+    h.Targets = append(h.Targets, StagingTarget{Name: n, Proxy: httputil.NewSingleHostReverseProxy(sURL)})
+  }
+  return h
+}
+
+//stagingTargets returns the targets r is mirrored to.  A plain
+//ProxyHandler has a single unnamed target
+func (p KyogetsuProxy) stagingTargets(r *http.Request) []StagingTarget {
+  if m, ok := p.ph.(MultiStagingHandler); ok {
+    return m.StagingTargets(r)
+  }
+  return []StagingTarget{{Proxy: p.ph.Staging(r)}}
+}
+
+//forTarget returns a copy of p whose CookieCache,
+//SessionStateCache and SessionIdMap are namespaced to the
+//target.  The unnamed target uses the caches as they are
+func (p KyogetsuProxy) forTarget(t StagingTarget) KyogetsuProxy {
+  if t.Name != "" {
+    p.ccache = namespacedCookieCache{c: p.ccache, ns: t.Name}
+    if p.state != nil {
+      p.state = namespacedStateCache{c: p.state, ns: t.Name}
+    }
+    if p.idMap != nil {
+      p.idMap = namespacedIdMap{m: p.idMap, ns: t.Name}
+    }
+  }
+  return p
+}
+
+//namespacedCookieCache stores the cookies of a staging target
+//under ids prefixed with the target name
+type namespacedCookieCache struct {
+  c CookieCache
+  ns string
+}
+
+func (n namespacedCookieCache) id(id string) string {
+  return n.ns + "/" + id
+}
+
+func (n namespacedCookieCache) SetCookie(id string, c *http.Cookie) error {
+  return n.c.SetCookie(n.id(id), c)
+}
+
+func (n namespacedCookieCache) SetCookies(id string, c []*http.Cookie) error {
+  return n.c.SetCookies(n.id(id), c)
+}
+
+func (n namespacedCookieCache) GetCookie(id string, key string) (*http.Cookie, error) {
+  return n.c.GetCookie(n.id(id), key)
+}
+
+func (n namespacedCookieCache) GetCookies(id string) ([]*http.Cookie, error) {
+  return n.c.GetCookies(n.id(id))
+}
+
+func (n namespacedCookieCache) DeleteCookie(id string, key string) error {
+  return n.c.DeleteCookie(n.id(id), key)
+}
+
+func (n namespacedCookieCache) DeleteCookies(id string, keys []string) error {
+  return n.c.DeleteCookies(n.id(id), keys)
+}
+
+func (n namespacedCookieCache) ChangeCookiesId(old_id string, new_id string) error {
+  return n.c.ChangeCookiesId(n.id(old_id), n.id(new_id))
+}
+
+//namespacedStateCache stores the session state of a staging
+//target under ids prefixed with the target name
+type namespacedStateCache struct {
+  c SessionStateCache
+  ns string
+}
+
+func (n namespacedStateCache) id(id string) string {
+  return n.ns + "/" + id
+}
+
+func (n namespacedStateCache) SetState(id string, values map[string]string) error {
+  return n.c.SetState(n.id(id), values)
+}
+
+func (n namespacedStateCache) GetState(id string) (map[string]string, error) {
+  return n.c.GetState(n.id(id))
+}
+
+func (n namespacedStateCache) ChangeStateId(old_id string, new_id string) error {
+  return n.c.ChangeStateId(n.id(old_id), n.id(new_id))
+}
+
+//releaseAfter returns a function that calls f the n-th time it
+//is called
+func releaseAfter(n int, f func()) func() {
+  left := int32(n)
+  return func() {
+    if atomic.AddInt32(&left, -1) == 0 {
+      f()
+    }
+  }
+}
@@ -0,0 +1,89 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  )
+
+func TestNewMultiProxyHandler(t *testing.T) {
+  mp := NewMultiProxyHandler("http://prod.example.com/", map[string]string{
+    "rc2": "http://rc2.example.com/",
+    "canary": "http://canary.example.com/",
+  })
+  if len(mp.Targets) != 2 {
+    t.Fatalf("Expected: 2 targets Got: %d", len(mp.Targets))
+  }
+  if mp.Targets[0].Name != "canary" || mp.Targets[1].Name != "rc2" {
+    t.Errorf("Targets are not ordered by name: %s %s", mp.Targets[0].Name, mp.Targets[1].Name)
+  }
+
+  r := newTestRequest()
+  mp.Targets[1].Proxy.Director(r)
+  if r.URL.String() != "http://rc2.example.com/" {
+    t.Errorf("Expected: http://rc2.example.com/ Got: %s", r.URL.String())
+  }
+  if mp.Staging(r) != mp.Targets[0].Proxy {
+    t.Error("Staging should return the first target")
+  }
+}
+
+func TestServeHTTPFansOut(t *testing.T) {
+  ps := newProdServer()
+  defer ps.Close()
+
+  rc1 := newCookieServer("rc1", nil)
+  defer rc1.Close()
+
+  rc2 := newCookieServer("rc2", nil)
+  defer rc2.Close()
+
+  ph := NewMultiProxyHandler(ps.URL, map[string]string{"rc1": rc1.URL, "rc2": rc2.URL})
+  ms := make(chanSender, 2)
+  fc := getMemoryCache()
+  k := NewKyogetsuProxyWithOptions(ph, ms, fc, CookieIdFunction("id"), Options{})
+
+  r, _ := http.NewRequest("GET", ps.URL + "/", nil)
+  r.AddCookie(&http.Cookie{Name: "id", Value: "bob"})
+  k.ServeHTTP(httptest.NewRecorder(), r)
+
+  got := map[string]string{}
+  for i := 0; i < 2; i++ {
+    m := waitMessage(t, ms)
+    got[m.Target] = m.StagingReponse.Body
+  }
+  for _, name := range []string{"rc1", "rc2"} {
+    if got[name] != name {
+      t.Errorf("Target %s Expected: %s Got: %s", name, name, got[name])
+    }
+  }
+}
+
+func TestNamespacedCookieCache(t *testing.T) {
+  fc := getMemoryCache()
+  k := NewKyogetsuProxy(SingleProxyHandler{}, dummySender{}, fc, CookieIdFunction("id"))
+  a := k.forTarget(StagingTarget{Name: "a"})
+  b := k.forTarget(StagingTarget{Name: "b"})
+
+  a.ccache.SetCookie("bob", &http.Cookie{Name: "server", Value: "a"})
+  b.ccache.SetCookie("bob", &http.Cookie{Name: "server", Value: "b"})
+  a.ccache.ChangeCookiesId("bob", "bill")
+
+  if c, err := a.ccache.GetCookie("bill", "server"); err != nil || c.Value != "a" {
+    t.Errorf("Target a lost its cookie: %v %v", c, err)
+  }
+  if c, err := b.ccache.GetCookie("bob", "server"); err != nil || c.Value != "b" {
+    t.Errorf("Target b lost its cookie: %v %v", c, err)
+  }
+  if c, _ := fc.GetCookies("b/bob"); len(c) == 0 {
+    t.Error("Expected the cookies of target b under b/bob")
+  }
+  if k.forTarget(StagingTarget{}).ccache != CookieCache(fc) {
+    t.Error("The unnamed target should use the cache as is")
+  }
+}
@@ -0,0 +1,111 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httptest"
+)
+
+//teeResponseWriter is an http.ResponseWriter that passes the
+//production response straight through to the client while
+//keeping a copy of at most limit bytes of the body for the
+//Message sent after staging is done
+type teeResponseWriter struct {
+  w http.ResponseWriter
+  rec *httptest.ResponseRecorder
+  limit int64
+  truncated bool
+  wroteHeader bool
+}
+
+//newTeeResponseWriter wraps w, capturing up to limit bytes
+//of the body.  A limit less than zero captures everything
+func newTeeResponseWriter(w http.ResponseWriter, limit int64) *teeResponseWriter {
+  return &teeResponseWriter{w: w, rec: httptest.NewRecorder(), limit: limit}
+}
+
+//Header returns the header map of the client's ResponseWriter
+//so the production proxy writes its headers directly to it
+func (t *teeResponseWriter) Header() http.Header {
+  return t.w.Header()
+}
+
+//WriteHeader sends the status code to the client and records
+//a snapshot of the headers as they were sent
+func (t *teeResponseWriter) WriteHeader(code int) {
+  if t.wroteHeader {
+    return
+  }
+  //informational responses are passed on, the real status follows
+  if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+    t.w.WriteHeader(code)
+    return
+  }
+  t.wroteHeader = true
+  t.snapshotHeader()
+  t.rec.WriteHeader(code)
+  t.w.WriteHeader(code)
+}
+
+//Write sends b to the client and records as much of it as
+//the limit allows
+func (t *teeResponseWriter) Write(b []byte) (int, error) {
+  if !t.wroteHeader {
+    t.WriteHeader(http.StatusOK)
+  }
+  n, err := t.w.Write(b)
+  t.capture(b[:n])
+  return n, err
+}
+
+//Flush flushes the client's ResponseWriter if it supports it
+func (t *teeResponseWriter) Flush() {
+  if f, ok := t.w.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+//Unwrap returns the client's ResponseWriter so that an
+//http.ResponseController can reach its optional methods
+func (t *teeResponseWriter) Unwrap() http.ResponseWriter {
+  return t.w
+}
+
+//Recorded returns the recorded copy of the response.  If the
+//handler never wrote anything the headers are captured now
+func (t *teeResponseWriter) Recorded() *httptest.ResponseRecorder {
+  if !t.wroteHeader {
+    t.snapshotHeader()
+  }
+  return t.rec
+}
+
+//Truncated reports whether part of the body was not recorded
+func (t *teeResponseWriter) Truncated() bool {
+  return t.truncated
+}
+
+func (t *teeResponseWriter) snapshotHeader() {
+  h := t.rec.Header()
+  for k, v := range t.w.Header() {
+    h[k] = append([]string(nil), v...)
+  }
+}
+
+func (t *teeResponseWriter) capture(b []byte) {
+  if t.limit >= 0 {
+    remaining := t.limit - int64(t.rec.Body.Len())
+    if remaining < int64(len(b)) {
+      t.truncated = true
+      if remaining <= 0 {
+        return
+      }
+      b = b[:remaining]
+    }
+  }
+  t.rec.Body.Write(b)
+}
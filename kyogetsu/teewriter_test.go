@@ -0,0 +1,82 @@
+/* Copyright Dylan Enloe 2017
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package kyogetsu
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  )
+
+func TestTeeResponseWriterPassesThrough(t *testing.T) {
+  tests := []struct {
+    Limit int64
+    Body string
+    Recorded string
+    Truncated bool
+  } {
+    {-1, "the whole body", "the whole body", false},
+    {100, "short body", "short body", false},
+    {4, "a longer body", "a lo", true},
+    {0, "nothing kept", "", true},
+  }
+  for _, test := range tests {
+    w := httptest.NewRecorder()
+    tw := newTeeResponseWriter(w, test.Limit)
+    tw.Header().Set("X-Test", "yes")
+    tw.WriteHeader(201)
+    tw.Write([]byte(test.Body))
+
+    if w.Code != 201 {
+      t.Errorf("Client Status Expected: 201 Got: %d", w.Code)
+    }
+    if w.Body.String() != test.Body {
+      t.Errorf("Client Body Expected: %s Got: %s", test.Body, w.Body.String())
+    }
+    rec := tw.Recorded()
+    if rec.Code != 201 {
+      t.Errorf("Recorded Status Expected: 201 Got: %d", rec.Code)
+    }
+    if rec.Header().Get("X-Test") != "yes" {
+      t.Errorf("Recorded Header Expected: yes Got: %s", rec.Header().Get("X-Test"))
+    }
+    if rec.Body.String() != test.Recorded {
+      t.Errorf("Recorded Body Expected: %s Got: %s", test.Recorded, rec.Body.String())
+    }
+    if tw.Truncated() != test.Truncated {
+      t.Errorf("Truncated Expected: %t Got: %t", test.Truncated, tw.Truncated())
+    }
+  }
+}
+
+func TestTeeResponseWriterImplicitHeader(t *testing.T) {
+  w := httptest.NewRecorder()
+  tw := newTeeResponseWriter(w, -1)
+  tw.Header().Set("Content-Type", "text/plain")
+  tw.Write([]byte("body"))
+  tw.Header().Set("X-Late", "ignored")
+
+  rec := tw.Recorded()
+  if rec.Code != http.StatusOK {
+    t.Errorf("Expected: 200 Got: %d", rec.Code)
+  }
+  if rec.Header().Get("Content-Type") != "text/plain" {
+    t.Errorf("Expected: text/plain Got: %s", rec.Header().Get("Content-Type"))
+  }
+  if rec.Header().Get("X-Late") != "" {
+    t.Error("Headers set after the response started should not be recorded")
+  }
+}
+
+func TestTeeResponseWriterFlush(t *testing.T) {
+  w := httptest.NewRecorder()
+  tw := newTeeResponseWriter(w, -1)
+  tw.Write([]byte("partial"))
+  tw.Flush()
+  if !w.Flushed {
+    t.Error("Flush was not passed through to the client")
+  }
+}